@@ -83,7 +83,7 @@ func ArgTypeName(s string) (a Arg, n int, err error) {
 
 	if s[0] == '*' {
 		nn := indexFunc(s[1:], unicode.IsSpace, false)
-		if s[1+nn] == ',' || s[1+nn] == ')' {
+		if 1+nn >= len(s) || s[1+nn] == ',' || s[1+nn] == ')' {
 			arg.Any = true
 			return arg, n + 1 + nn, nil
 		}
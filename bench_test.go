@@ -0,0 +1,106 @@
+package rbxfs
+
+import (
+	"fmt"
+	"github.com/robloxapi/rbxfile"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	benchPlace   = "bench.rbxl"
+	benchFolders = 50
+	benchScripts = 40
+)
+
+// benchRepo creates a repository using the scripts preset, containing a
+// place with benchFolders folders of benchScripts scripts each. The place is
+// synced out, so that the repository can also be synced in. Returns the
+// repository, which should be removed by the caller.
+func benchRepo(b *testing.B) string {
+	service := rbxfile.NewInstance("ReplicatedStorage", nil)
+	service.IsService = true
+	source := rbxfile.ValueProtectedString(strings.Repeat("local x = 1\n", 100))
+	for i := 0; i < benchFolders; i++ {
+		folder := rbxfile.NewInstance("Folder", service)
+		folder.SetName(fmt.Sprintf("Folder%d", i))
+		for j := 0; j < benchScripts; j++ {
+			script := rbxfile.NewInstance("ModuleScript", folder)
+			script.SetName(fmt.Sprintf("Module%d", j))
+			script.Set("Source", source)
+		}
+	}
+	return syncedRepo(b, benchPlace, service)
+}
+
+// syncedRepo creates a repository using the scripts preset, containing a
+// place with the given instances. The place is synced out, so that the
+// repository can also be synced in. Returns the repository, which should be
+// removed by the caller.
+func syncedRepo(tb testing.TB, place string, instances ...*rbxfile.Instance) string {
+	repo, err := ioutil.TempDir("", "rbxfs-repo")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	opt := benchOptions(repo)
+	err = InitRepo(opt, &InitOptions{Preset: "scripts"})
+	if err == nil {
+		var f *os.File
+		if f, err = os.Create(filepath.Join(repo, place)); err == nil {
+			err = encodePlaceFile(f, place, nil, &rbxfile.Root{Instances: instances})
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err == nil {
+		err = SyncOutReadRepo(opt, []string{place})
+	}
+	if err != nil {
+		os.RemoveAll(repo)
+		tb.Fatal(err)
+	}
+	return repo
+}
+
+// benchOptions returns options for repo that exclude any global rules.
+func benchOptions(repo string) *Options {
+	return &Options{Repo: repo, ConfigDir: filepath.Join(repo, "config")}
+}
+
+// benchFileWorkers runs plan with FileWorkers set to 1, and to the number of
+// CPUs.
+func benchFileWorkers(b *testing.B, plan func(opt *Options) error) {
+	repo := benchRepo(b)
+	defer os.RemoveAll(repo)
+	for _, n := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("FileWorkers=%d", n), func(b *testing.B) {
+			opt := benchOptions(repo)
+			opt.Workers = 1
+			opt.FileWorkers = n
+			for i := 0; i < b.N; i++ {
+				if err := plan(opt); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSyncOut(b *testing.B) {
+	benchFileWorkers(b, func(opt *Options) error {
+		_, err := PlanOut(opt, []string{benchPlace})
+		return err
+	})
+}
+
+func BenchmarkSyncIn(b *testing.B) {
+	benchFileWorkers(b, func(opt *Options) error {
+		_, err := PlanIn(opt, []string{getPlaceDir(benchPlace)})
+		return err
+	})
+}
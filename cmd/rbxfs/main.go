@@ -0,0 +1,328 @@
+// The rbxfs command syncs places with directories of files.
+//
+// Usage:
+//
+//	rbxfs <command> [flags] [args...]
+//
+// The commands are:
+//
+//	init              create .rbxfs with the default rules and services
+//	out [places...]   sync places out to directories
+//	in [dirs...]      sync directories in to new place files
+//	status [places]   summarize the changes that syncing out would make
+//	diff [places...]  list the differences between places and directories
+//	verify [places]   list what is lost by syncing places out and back in
+//	rules             print the global and project rules
+//
+// Each command accepts the following flags:
+//
+//	-repo path   the repository (default ".")
+//	-api path    the API dump used to determine class inheritance
+//	-n           show the changes that would be made, without making them
+//	-v           write loaded rules and unchanged files
+//	-json        write output as lines of JSON
+//
+// The init command also accepts the following flags:
+//
+//	-preset name use a built-in preset (minimal, scripts, rojo-like,
+//	             full-directory; default scripts)
+//	-from place  derive the rules from the classes of objects within a place
+//	-force       replace an existing rule file
+//
+// The exit code is 0 if the command succeeded and nothing differs, 1 if there
+// are changes (shown by -n, status, diff, or verify), and 2 if an error
+// occurred.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/anaminus/rbxfs"
+	"github.com/robloxapi/rbxapi/dump"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	exitOK      = 0
+	exitChanges = 1
+	exitError   = 2
+)
+
+const usage = `usage: rbxfs <command> [flags] [args...]
+
+commands:
+	init              create .rbxfs with the default rules and services
+	out [places...]   sync places out to directories
+	in [dirs...]      sync directories in to new place files
+	status [places]   summarize the changes that syncing out would make
+	diff [places...]  list the differences between places and directories
+	verify [places]   list what is lost by syncing places out and back in
+	rules             print the global and project rules
+`
+
+// command holds the flags shared by each command.
+type command struct {
+	flags   *flag.FlagSet
+	repo    string
+	api     string
+	dryRun  bool
+	verbose bool
+	json    bool
+	preset  string
+	from    string
+	force   bool
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func newCommand(name string) *command {
+	c := &command{
+		flags:  flag.NewFlagSet("rbxfs "+name, flag.ExitOnError),
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+	c.flags.StringVar(&c.repo, "repo", ".", "the repository")
+	c.flags.StringVar(&c.api, "api", "", "the API dump used to determine class inheritance")
+	c.flags.BoolVar(&c.dryRun, "n", false, "show the changes that would be made, without making them")
+	c.flags.BoolVar(&c.verbose, "v", false, "write loaded rules and unchanged files")
+	c.flags.BoolVar(&c.json, "json", false, "write output as lines of JSON")
+	if name == "init" {
+		c.flags.StringVar(&c.preset, "preset", rbxfs.DefaultPreset, "the built-in preset ("+strings.Join(rbxfs.Presets(), ", ")+")")
+		c.flags.StringVar(&c.from, "from", "", "derive the rules from the classes of objects within a place")
+		c.flags.BoolVar(&c.force, "force", false, "replace an existing rule file")
+	}
+	return c
+}
+
+// options returns the options of the command, loading the API dump if one
+// was given.
+func (c *command) options() (*rbxfs.Options, error) {
+	opt := &rbxfs.Options{Repo: c.repo}
+	if c.api != "" {
+		f, err := os.Open(c.api)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if opt.API, err = dump.Decode(f); err != nil {
+			return nil, fmt.Errorf("decode API dump: %s", err)
+		}
+	}
+	if c.json {
+		opt.Reporter = rbxfs.NewJSONReporter(c.stdout)
+	} else {
+		opt.Reporter = rbxfs.NewConsoleReporter(c.stdout, c.verbose)
+	}
+	return opt, nil
+}
+
+// fail writes err and returns the error exit code.
+func (c *command) fail(err error) int {
+	if c.json {
+		json.NewEncoder(c.stdout).Encode(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Fprintln(c.stderr, "rbxfs:", err)
+	}
+	return exitError
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitError)
+	}
+	name := os.Args[1]
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rbxfs: unknown command %q\n\n%s", name, usage)
+		os.Exit(exitError)
+	}
+	c := newCommand(name)
+	c.flags.Parse(os.Args[2:])
+	os.Exit(run(c, c.flags.Args()))
+}
+
+var commands = map[string]func(c *command, args []string) int{
+	"init":   runInit,
+	"out":    runOut,
+	"in":     runIn,
+	"status": runStatus,
+	"diff":   runDiff,
+	"verify": runVerify,
+	"rules":  runRules,
+}
+
+func runInit(c *command, args []string) int {
+	opt, err := c.options()
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := rbxfs.InitRepo(opt, &rbxfs.InitOptions{Preset: c.preset, Place: c.from, Force: c.force}); err != nil {
+		return c.fail(err)
+	}
+	return exitOK
+}
+
+// writePlans writes each plan, and returns whether any plan has changes.
+func (c *command) writePlans(plans []*rbxfs.Plan) (changed bool) {
+	enc := json.NewEncoder(c.stdout)
+	for _, plan := range plans {
+		if c.json {
+			enc.Encode(plan)
+		} else {
+			plan.WriteReport(c.stdout)
+		}
+		if plan.HasChanges() {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// runSync runs a sync, or plans it if -n was given.
+func (c *command) runSync(args []string, sync func(*rbxfs.Options, []string) error, plan func(*rbxfs.Options, []string) ([]*rbxfs.Plan, error)) int {
+	opt, err := c.options()
+	if err != nil {
+		return c.fail(err)
+	}
+	if !c.dryRun {
+		if err := sync(opt, args); err != nil {
+			return c.fail(err)
+		}
+		return exitOK
+	}
+	// Plans are written in full, so events are only needed for errors.
+	opt.Reporter = nil
+	plans, err := plan(opt, args)
+	changed := c.writePlans(plans)
+	if err != nil {
+		return c.fail(err)
+	}
+	if changed {
+		return exitChanges
+	}
+	return exitOK
+}
+
+func runOut(c *command, args []string) int {
+	return c.runSync(args, rbxfs.SyncOutReadRepo, rbxfs.PlanOut)
+}
+
+func runIn(c *command, args []string) int {
+	return c.runSync(args, rbxfs.SyncInReadRepo, rbxfs.PlanIn)
+}
+
+func runStatus(c *command, args []string) int {
+	opt, err := c.options()
+	if err != nil {
+		return c.fail(err)
+	}
+	opt.Reporter = nil
+	plans, err := rbxfs.PlanOut(opt, args)
+	changed := false
+	enc := json.NewEncoder(c.stdout)
+	for _, plan := range plans {
+		stats := plan.Stats()
+		if c.json {
+			enc.Encode(struct {
+				Place string          `json:"place"`
+				Dir   string          `json:"dir"`
+				Stats rbxfs.PlanStats `json:"stats"`
+			}{plan.Name, plan.Target, stats})
+		} else if plan.HasChanges() {
+			fmt.Fprintf(c.stdout, "%s -> %s: %s\n", plan.Name, plan.Target, stats)
+		} else {
+			fmt.Fprintf(c.stdout, "%s -> %s: up to date\n", plan.Name, plan.Target)
+		}
+		if plan.HasChanges() {
+			changed = true
+		}
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	if changed {
+		return exitChanges
+	}
+	return exitOK
+}
+
+func runDiff(c *command, args []string) int {
+	opt, err := c.options()
+	if err != nil {
+		return c.fail(err)
+	}
+	diffs, err := rbxfs.DiffPlaces(opt, args)
+	changed := false
+	enc := json.NewEncoder(c.stdout)
+	for _, d := range diffs {
+		if !d.HasChanges() {
+			continue
+		}
+		changed = true
+		if c.json {
+			enc.Encode(d)
+		} else {
+			d.WriteReport(c.stdout)
+		}
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	if changed {
+		return exitChanges
+	}
+	return exitOK
+}
+
+func runVerify(c *command, args []string) int {
+	opt, err := c.options()
+	if err != nil {
+		return c.fail(err)
+	}
+	// Only the differences are of interest, not the syncs that find them.
+	opt.Reporter = nil
+	results, err := rbxfs.VerifyRoundTrip(opt, args)
+	changed := false
+	enc := json.NewEncoder(c.stdout)
+	for _, rt := range results {
+		if c.json {
+			enc.Encode(rt)
+		} else {
+			rt.WriteReport(c.stdout)
+		}
+		if !rt.Lossless() {
+			changed = true
+		}
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	if changed {
+		return exitChanges
+	}
+	return exitOK
+}
+
+func runRules(c *command, args []string) int {
+	opt, err := c.options()
+	if err != nil {
+		return c.fail(err)
+	}
+	rules, err := rbxfs.LoadRules(opt)
+	enc := json.NewEncoder(c.stdout)
+	for _, rule := range rules {
+		if c.json {
+			enc.Encode(rule.String())
+		} else {
+			fmt.Fprintln(c.stdout, rule)
+		}
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	return exitOK
+}
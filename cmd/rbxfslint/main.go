@@ -0,0 +1,56 @@
+// The rbxfslint command checks rbxfs rule files for errors and likely
+// mistakes.
+//
+// Usage:
+//
+//	rbxfslint [-json] [-strict] [files...]
+//
+// If no files are given, then the project rule file of the current directory
+// is checked. Each problem is written to standard output, either as a line of
+// text, or as a line of JSON when -json is given.
+//
+// The exit code is 0 if no errors were found, 1 if errors were found (or
+// warnings, when -strict is given), and 2 if a file could not be read.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/anaminus/rbxfs"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "write each diagnostic as a line of JSON")
+	strict := flag.Bool("strict", false, "fail on warnings as well as errors")
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{filepath.Join(rbxfs.ProjectMetaDir, rbxfs.RulesFileName)}
+	}
+
+	status := 0
+	enc := json.NewEncoder(os.Stdout)
+	for _, file := range files {
+		diags, err := rbxfs.LintRuleFile(nil, file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		for _, d := range diags {
+			if *asJSON {
+				enc.Encode(d)
+			} else {
+				fmt.Println(d)
+			}
+			if status == 0 && (d.Severity == rbxfs.SeverityError || *strict) {
+				status = 1
+			}
+		}
+	}
+	os.Exit(status)
+}
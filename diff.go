@@ -0,0 +1,346 @@
+package rbxfs
+
+import (
+	"fmt"
+	"github.com/robloxapi/rbxfile"
+	"io"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DiffKind indicates the kind of a Difference.
+type DiffKind byte
+
+const (
+	// DiffAdded indicates an instance or property that exists only in the
+	// second tree.
+	DiffAdded DiffKind = iota
+	// DiffRemoved indicates an instance or property that exists only in the
+	// first tree.
+	DiffRemoved
+	// DiffChanged indicates an instance or property that exists in both
+	// trees, but differs.
+	DiffChanged
+	// DiffMoved indicates an instance that exists in both trees, but under
+	// a different parent.
+	DiffMoved
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffChanged:
+		return "changed"
+	case DiffMoved:
+		return "moved"
+	}
+	return ""
+}
+
+func (k DiffKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Difference is a structural difference between two trees of instances.
+type Difference struct {
+	Kind DiffKind `json:"kind"`
+	// Path is the path of the instance, as a list of names separated by
+	// dots.
+	Path string `json:"path"`
+	// Property is the name of the property that differs. If empty, then the
+	// difference applies to the instance itself.
+	Property string `json:"property,omitempty"`
+	// Old and New describe the differing item in the first and second tree.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+	// To is the path of a moved instance within the second tree.
+	To string `json:"to,omitempty"`
+}
+
+func (d Difference) String() string {
+	path := d.Path
+	if d.Property != "" {
+		path += "[" + d.Property + "]"
+	}
+	switch d.Kind {
+	case DiffAdded:
+		if d.New != "" {
+			return fmt.Sprintf("+ %s = %s", path, d.New)
+		}
+		return fmt.Sprintf("+ %s", path)
+	case DiffRemoved:
+		if d.Old != "" {
+			return fmt.Sprintf("- %s = %s", path, d.Old)
+		}
+		return fmt.Sprintf("- %s", path)
+	case DiffMoved:
+		return fmt.Sprintf("> %s -> %s", path, d.To)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", path, d.Old, d.New)
+}
+
+// fullPath returns the names of obj and each of its ancestors, separated by
+// dots.
+func fullPath(obj *rbxfile.Instance) string {
+	var names []string
+	for ; obj != nil; obj = obj.Parent() {
+		names = append(names, obj.Name())
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, ".")
+}
+
+func describeValue(v rbxfile.Value) string {
+	if ref, ok := v.(rbxfile.ValueReference); ok {
+		if ref.Instance == nil {
+			return "Reference(nil)"
+		}
+		return fmt.Sprintf("Reference(%s)", fullPath(ref.Instance))
+	}
+	return fmt.Sprintf("%s(%s)", v.Type(), v.String())
+}
+
+// valuesEqual returns whether two property values are equal. References are
+// equal if they refer to instances with the same path.
+func valuesEqual(a, b rbxfile.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a := a.(type) {
+	case rbxfile.ValueReference:
+		b := b.(rbxfile.ValueReference)
+		if a.Instance == nil || b.Instance == nil {
+			return a.Instance == b.Instance
+		}
+		return fullPath(a.Instance) == fullPath(b.Instance)
+	case rbxfile.ValueFloat:
+		b := b.(rbxfile.ValueFloat)
+		return a == b || math.IsNaN(float64(a)) && math.IsNaN(float64(b))
+	case rbxfile.ValueDouble:
+		b := b.(rbxfile.ValueDouble)
+		return a == b || math.IsNaN(float64(a)) && math.IsNaN(float64(b))
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// CompareRoots returns the structural differences between two trees of
+// instances. Instances are compared by class, properties, and children.
+// Children are matched by name, and a difference in the order of matched
+// children is also reported. An instance that was removed from one location
+// and added to another, with the same name and class, is reported as moved.
+// Differences are sorted by path.
+func CompareRoots(a, b *rbxfile.Root) []Difference {
+	var c comparer
+	c.children("", a.Instances, b.Instances)
+
+	// Pair removed instances with added instances to detect moves. Comparing
+	// a moved instance may find further unmatched instances, so the lists
+	// are allowed to grow while they are scanned.
+	used := map[int]bool{}
+	for k := 0; k < len(c.removed); k++ {
+		r := c.removed[k]
+		moved := false
+		for i := 0; i < len(c.added); i++ {
+			a := c.added[i]
+			if used[i] || a.obj.Name() != r.obj.Name() || a.obj.ClassName != r.obj.ClassName {
+				continue
+			}
+			used[i] = true
+			moved = true
+			c.diffs = append(c.diffs, Difference{Kind: DiffMoved, Path: r.path, To: a.path})
+			c.instance(a.path, r.obj, a.obj)
+			break
+		}
+		if !moved {
+			c.diffs = append(c.diffs, Difference{Kind: DiffRemoved, Path: r.path, Old: r.obj.ClassName})
+		}
+	}
+	for i, a := range c.added {
+		if !used[i] {
+			c.diffs = append(c.diffs, Difference{Kind: DiffAdded, Path: a.path, New: a.obj.ClassName})
+		}
+	}
+
+	sort.SliceStable(c.diffs, func(i, j int) bool {
+		return c.diffs[i].Path < c.diffs[j].Path
+	})
+	return c.diffs
+}
+
+type unmatched struct {
+	path string
+	obj  *rbxfile.Instance
+}
+
+type comparer struct {
+	diffs   []Difference
+	removed []unmatched
+	added   []unmatched
+}
+
+func joinPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func (c *comparer) children(path string, a, b []*rbxfile.Instance) {
+	// Match each child in a with the first unmatched child in b of the same
+	// name.
+	matched := make([]int, len(a))
+	used := make([]bool, len(b))
+	for i, ca := range a {
+		matched[i] = -1
+		for j, cb := range b {
+			if !used[j] && cb.Name() == ca.Name() {
+				matched[i] = j
+				used[j] = true
+				break
+			}
+		}
+	}
+
+	last := -1
+	ordered := true
+	for i, ca := range a {
+		j := matched[i]
+		if j < 0 {
+			c.removed = append(c.removed, unmatched{joinPath(path, ca.Name()), ca})
+			continue
+		}
+		if j < last {
+			ordered = false
+		}
+		last = j
+		c.instance(joinPath(path, ca.Name()), ca, b[j])
+	}
+	for j, cb := range b {
+		if !used[j] {
+			c.added = append(c.added, unmatched{joinPath(path, cb.Name()), cb})
+		}
+	}
+	if !ordered {
+		names := func(children []*rbxfile.Instance) string {
+			s := make([]string, len(children))
+			for i, child := range children {
+				s[i] = child.Name()
+			}
+			return strings.Join(s, ", ")
+		}
+		c.diffs = append(c.diffs, Difference{
+			Kind: DiffChanged,
+			Path: path,
+			Old:  "children (" + names(a) + ")",
+			New:  "children (" + names(b) + ")",
+		})
+	}
+}
+
+func (c *comparer) instance(path string, a, b *rbxfile.Instance) {
+	if a.ClassName != b.ClassName {
+		c.diffs = append(c.diffs, Difference{Kind: DiffChanged, Path: path, Old: a.ClassName, New: b.ClassName})
+	}
+
+	names := make([]string, 0, len(a.Properties)+len(b.Properties))
+	for name := range a.Properties {
+		names = append(names, name)
+	}
+	for name := range b.Properties {
+		if _, ok := a.Properties[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		va, oka := a.Properties[name]
+		vb, okb := b.Properties[name]
+		switch {
+		case !okb:
+			c.diffs = append(c.diffs, Difference{Kind: DiffRemoved, Path: path, Property: name, Old: describeValue(va)})
+		case !oka:
+			c.diffs = append(c.diffs, Difference{Kind: DiffAdded, Path: path, Property: name, New: describeValue(vb)})
+		case !valuesEqual(va, vb):
+			c.diffs = append(c.diffs, Difference{Kind: DiffChanged, Path: path, Property: name, Old: describeValue(va), New: describeValue(vb)})
+		}
+	}
+
+	c.children(path, a.Children, b.Children)
+}
+
+// TreeDiff is the structural difference between the tree of instances built
+// from a directory, and the tree within the corresponding place.
+type TreeDiff struct {
+	Place string `json:"place"`
+	Dir   string `json:"dir"`
+	// Differences lists each difference from the tree of the directory to
+	// the tree of the place.
+	Differences []Difference `json:"differences"`
+}
+
+// HasChanges returns whether the place differs from the directory.
+func (d *TreeDiff) HasChanges() bool {
+	return len(d.Differences) > 0
+}
+
+// WriteReport writes a human-readable list of differences to w.
+func (d *TreeDiff) WriteReport(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "diff `%s` -> `%s`\n", d.Dir, d.Place); err != nil {
+		return err
+	}
+	for _, diff := range d.Differences {
+		if _, err := fmt.Fprintf(w, "\t%s\n", diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffPlaces compares each place in placeNames with the tree built by syncing
+// in the place's directory, without writing any files. If placeNames is
+// empty, then all places in the repository are compared.
+func DiffPlaces(opt *Options, placeNames []string) ([]*TreeDiff, error) {
+	rules, placeNames, err := loadRepo(opt, placeNames, getPlacesInRepo)
+	if err != nil {
+		return nil, err
+	}
+	rules = filterRuleType(rules, SyncIn)
+
+	results := make([]*TreeDiff, len(placeNames))
+	kept, err := eachName(opt, placeNames, func(i int, opt *Options) (ok bool, err error) {
+		results[i], err = diffPlace(opt, placeNames[i], rules)
+		return results[i] != nil, err
+	})
+	out := make([]*TreeDiff, len(kept))
+	for j, i := range kept {
+		out[j] = results[i]
+	}
+	return out, err
+}
+
+func diffPlace(opt *Options, name string, rules []RulePair) (*TreeDiff, error) {
+	place, err := decodePlaceFile(filepath.Join(opt.Repo, name), opt.API)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := getPlaceDir(name)
+	sources := &SourceCache{}
+	refs := map[string]*rbxfile.Instance{}
+	actions, err := syncInReadDir(opt, sources, dir, []string{}, rules, refs, nil)
+	if err != nil {
+		return nil, err
+	}
+	actions = syncInAnalyzeActions(actions, nil)
+	tree := syncInBuildRoot(opt, refs, sources, actions)
+
+	return &TreeDiff{Place: name, Dir: dir, Differences: CompareRoots(tree, place)}, nil
+}
@@ -3,7 +3,6 @@ package rbxfs
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/robloxapi/rbxapi"
 	"github.com/robloxapi/rbxfile"
@@ -12,34 +11,120 @@ import (
 	"github.com/robloxapi/rbxfile/xml"
 	"io"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func GetFormatFromExt(ext string) Format {
-	ext = strings.TrimPrefix(ext, ".")
-	switch ext {
-	case FormatRBXM{}.Ext():
-		return &FormatRBXM{}
-	case FormatRBXMX{}.Ext():
-		return &FormatRBXMX{}
-	case FormatRBXL{}.Ext():
-		return &FormatRBXL{}
-	case FormatRBXLX{}.Ext():
-		return &FormatRBXLX{}
-	case FormatJSON{}.Ext():
-		return &FormatJSON{}
-	case FormatXML{}.Ext():
-		return &FormatXML{}
-	case FormatBin{}.Ext():
-		return &FormatBin{}
-	case FormatLua{}.Ext():
-		return &FormatLua{}
-	case FormatText{}.Ext():
-		return &FormatText{}
+// FormatRegistry associates file extensions with formats. An extension may
+// have multiple parts, such as "server.lua", in which case it takes
+// precedence over shorter extensions of the same file name.
+type FormatRegistry struct {
+	formats map[string]func() Format
+}
+
+// NewFormatRegistry returns an empty FormatRegistry.
+func NewFormatRegistry() *FormatRegistry {
+	return &FormatRegistry{formats: map[string]func() Format{}}
+}
+
+// normalizeExt returns ext without a leading dot, in lowercase.
+func normalizeExt(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// Register associates an extension with a function that returns a new
+// instance of a format, replacing any existing association. It returns r, so
+// that calls can be chained.
+func (r *FormatRegistry) Register(ext string, format func() Format) *FormatRegistry {
+	if r.formats == nil {
+		r.formats = map[string]func() Format{}
+	}
+	r.formats[normalizeExt(ext)] = format
+	return r
+}
+
+// Clone returns a copy of r, which can be modified without affecting r.
+func (r *FormatRegistry) Clone() *FormatRegistry {
+	c := NewFormatRegistry()
+	for ext, format := range r.formats {
+		c.formats[ext] = format
+	}
+	return c
+}
+
+// Exts returns a sorted list of registered extensions.
+func (r *FormatRegistry) Exts() []string {
+	exts := make([]string, 0, len(r.formats))
+	for ext := range r.formats {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// Lookup returns a new instance of the format associated with the given
+// extension, or nil if there is no such format.
+func (r *FormatRegistry) Lookup(ext string) Format {
+	if format, ok := r.formats[normalizeExt(ext)]; ok {
+		return format()
 	}
 	return nil
 }
 
+// FileExt returns the longest registered extension of a file name, without a
+// leading dot. Returns an empty string if no extension is registered.
+func (r *FormatRegistry) FileExt(name string) string {
+	name = strings.ToLower(filepath.Base(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if _, ok := r.formats[name[i+1:]]; ok {
+			return name[i+1:]
+		}
+	}
+	return ""
+}
+
+// FromFileName returns a new instance of the format associated with the
+// longest registered extension of a file name, or nil if there is no such
+// format.
+func (r *FormatRegistry) FromFileName(name string) Format {
+	ext := r.FileExt(name)
+	if ext == "" {
+		return nil
+	}
+	return r.formats[ext]()
+}
+
+// DefaultFormats is the registry of formats used when Options.Formats is
+// nil.
+var DefaultFormats = NewFormatRegistry().
+	Register(FormatRBXM{}.Ext(), func() Format { return &FormatRBXM{} }).
+	Register(FormatRBXMX{}.Ext(), func() Format { return &FormatRBXMX{} }).
+	Register(FormatRBXL{}.Ext(), func() Format { return &FormatRBXL{} }).
+	Register(FormatRBXLX{}.Ext(), func() Format { return &FormatRBXLX{} }).
+	Register(FormatJSON{}.Ext(), func() Format { return &FormatJSON{} }).
+	Register(FormatXML{}.Ext(), func() Format { return &FormatXML{} }).
+	Register(FormatBin{}.Ext(), func() Format { return &FormatBin{} }).
+	Register(FormatLua{}.Ext(), func() Format { return &FormatLua{} }).
+	Register(FormatText{}.Ext(), func() Format { return &FormatText{} })
+
+// GetFormatFromExt returns the format of DefaultFormats associated with the
+// given extension.
+func GetFormatFromExt(ext string) Format {
+	return DefaultFormats.Lookup(ext)
+}
+
+// getFormats returns the format registry of opt.
+func getFormats(opt *Options) *FormatRegistry {
+	if opt == nil || opt.Formats == nil {
+		return DefaultFormats
+	}
+	return opt.Formats
+}
+
 type ErrUnsupportedFormat struct {
 	Format string
 }
@@ -69,7 +154,7 @@ type ErrFormatSelection struct {
 }
 
 func (err ErrFormatSelection) Error() string {
-	return fmt.Sprintf("selection not supported by %s format")
+	return fmt.Sprintf("selection not supported by %s format", err.Format)
 }
 
 type ErrFormatBounds struct {
@@ -403,9 +488,8 @@ func (f *FormatJSON) SetReferences(refs map[string]*rbxfile.Instance) {
 	f.refs = refs
 }
 func (FormatJSON) CanEncode(sel []OutSelection) bool {
-	if len(sel) > 1 {
-		return false
-	} else if len(sel) == 1 && len(sel[0].Children) > 0 {
+	// Properties are encoded from a single object.
+	if len(sel) != 1 || len(sel[0].Children) > 0 {
 		return false
 	}
 	return true
@@ -503,19 +587,156 @@ func (f *FormatXML) SetReferences(refs map[string]*rbxfile.Instance) {
 	f.refs = refs
 }
 func (FormatXML) CanEncode(sel []OutSelection) bool {
-	if len(sel) > 1 {
-		return false
-	} else if len(sel) == 1 && len(sel[0].Children) > 0 {
+	// Properties are encoded from a single object.
+	if len(sel) != 1 || len(sel[0].Children) > 0 {
 		return false
 	}
 	return true
 }
+
+// xmlPropertiesTag is the name of the root tag of the XML format, which
+// contains the properties in the same form as the Properties tag of an Item
+// in the RBXMX format.
+const xmlPropertiesTag = "Properties"
+
+// xmlRefTag is the name of the tag containing a reference value.
+const xmlRefTag = "Ref"
+
 func (f FormatXML) Encode(w io.Writer, selections []OutSelection) error {
-	return errors.New("not implemented")
+	if !f.CanEncode(selections) {
+		return ErrFormatSelection{f.Name()}
+	}
+
+	refs := f.refs
+	if refs == nil {
+		refs = map[string]*rbxfile.Instance{}
+	}
+
+	// Encode non-reference values as the properties of a dummy instance, then
+	// extract the Properties tag. References are encoded separately, so that
+	// they refer to objects outside of the dummy instance.
+	obj := selections[0].Object
+	inst := rbxfile.NewInstance(obj.ClassName, nil)
+	var refTags []*xml.Tag
+	for _, name := range selections[0].Properties {
+		value, ok := obj.Properties[name]
+		if !ok {
+			continue
+		}
+		if ref, ok := value.(rbxfile.ValueReference); ok {
+			text := "null"
+			if ref.Instance != nil {
+				text = rbxfile.GetReference(ref.Instance, refs)
+			}
+			refTags = append(refTags, &xml.Tag{
+				StartName: xmlRefTag,
+				Attr:      []xml.Attr{{Name: "name", Value: name}},
+				Text:      text,
+			})
+			continue
+		}
+		inst.Properties[name] = value
+	}
+
+	codec := xml.RobloxCodec{API: f.api, ExcludeExternal: true}
+	doc, err := codec.Encode(&rbxfile.Root{Instances: []*rbxfile.Instance{inst}})
+	if err != nil {
+		return ErrFormatEncode{err}
+	}
+	props := findXMLTag(findXMLTag(doc.Root, "Item"), xmlPropertiesTag)
+	if props == nil {
+		props = &xml.Tag{StartName: xmlPropertiesTag}
+	}
+	props.Tags = append(props.Tags, refTags...)
+	sort.Stable(sortXMLProperties(props.Tags))
+	props.Empty = len(props.Tags) == 0
+
+	doc.Root = props
+	if _, err := doc.WriteTo(w); err != nil {
+		return ErrFormatEncode{err}
+	}
+	return nil
 }
 func (f FormatXML) Decode(r io.Reader) (is *ItemSource, err error) {
-	err = errors.New("not implemented")
-	return
+	doc := &xml.Document{}
+	if _, err := doc.ReadFrom(r); err != nil {
+		return nil, ErrFormatDecode{err}
+	}
+	props := doc.Root
+	if props == nil || props.StartName != xmlPropertiesTag {
+		return nil, ErrFormatDecode{fmt.Errorf("expected root tag %q", xmlPropertiesTag)}
+	}
+
+	// Extract references, which are resolved later.
+	refs := map[string]bool{}
+	refValues := map[string]rbxfile.Value{}
+	tags := make([]*xml.Tag, 0, len(props.Tags))
+	for _, tag := range props.Tags {
+		if tag.StartName == xmlRefTag {
+			if name, ok := tag.AttrValue("name"); ok {
+				refs[name] = true
+				refValues[name] = rbxfile.ValueString(strings.TrimSpace(tag.Text))
+				continue
+			}
+		}
+		tags = append(tags, tag)
+	}
+	props.Tags = tags
+
+	// Decode the remaining values as the properties of a dummy instance.
+	doc.Root = &xml.Tag{
+		StartName: "roblox",
+		Attr:      []xml.Attr{{Name: "version", Value: "4"}},
+		Tags: []*xml.Tag{{
+			StartName: "Item",
+			Attr:      []xml.Attr{{Name: "class", Value: ""}},
+			Tags:      []*xml.Tag{props},
+		}},
+	}
+	codec := xml.RobloxCodec{API: f.api}
+	root, err := codec.Decode(doc)
+	if err != nil {
+		return nil, ErrFormatDecode{err}
+	}
+	properties := map[string]rbxfile.Value{}
+	if len(root.Instances) > 0 {
+		for name, value := range root.Instances[0].Properties {
+			properties[name] = value
+		}
+	}
+	for name, value := range refValues {
+		properties[name] = value
+	}
+
+	return &ItemSource{Properties: properties, References: refs}, nil
+}
+
+// findXMLTag returns the first child of tag with the given name.
+func findXMLTag(tag *xml.Tag, name string) *xml.Tag {
+	if tag == nil {
+		return nil
+	}
+	for _, t := range tag.Tags {
+		if t.StartName == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// sortXMLProperties sorts property tags by name.
+type sortXMLProperties []*xml.Tag
+
+func (s sortXMLProperties) Len() int {
+	return len(s)
+}
+func (s sortXMLProperties) Less(i, j int) bool {
+	a, _ := s[i].AttrValue("name")
+	b, _ := s[j].AttrValue("name")
+	return a < b
+}
+func (s sortXMLProperties) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
 }
 
 type FormatBin struct {
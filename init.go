@@ -0,0 +1,268 @@
+package rbxfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/robloxapi/rbxapi"
+	"github.com/robloxapi/rbxapi/dump"
+	"github.com/robloxapi/rbxfile"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrRepoExists is returned by InitRepo when the repository already has a
+// project rule file.
+var ErrRepoExists = errors.New("repository already has a rule file")
+
+// gitignoreLines are the lines written to the .gitignore file of a new
+// repository. Places created by sync-in, and files that describe the state of
+// the local repository, are not tracked.
+var gitignoreLines = []string{
+	"new-*.rbxl",
+	"/" + ProjectMetaDir + "/" + StagingDirName + "/",
+	"/" + ProjectMetaDir + "/" + SnapshotDirName + "/",
+	"/" + ProjectMetaDir + "/" + ManifestDirName + "/",
+}
+
+// scriptClasses are the classes written as directories containing their
+// source by derived rules.
+var scriptClasses = []string{"Script", "LocalScript", "ModuleScript"}
+
+// defaultServices are the classes written to the services file of a new
+// repository when no place is given to take them from. These are the
+// services commonly found within a place.
+var defaultServices = []string{
+	"Chat",
+	"Lighting",
+	"LocalizationService",
+	"Players",
+	"ReplicatedFirst",
+	"ReplicatedStorage",
+	"ServerScriptService",
+	"ServerStorage",
+	"SoundService",
+	"StarterGui",
+	"StarterPack",
+	"StarterPlayer",
+	"Teams",
+	"TestService",
+	"Workspace",
+}
+
+// InitOptions configures InitRepo.
+type InitOptions struct {
+	// Preset is the name of the built-in preset used by the rule file. If
+	// empty, then DefaultPreset is used.
+	Preset string
+	// Place is the name of a place within the repository. If not empty, then
+	// the rule file is derived from the classes of the objects within the
+	// place, rather than using Preset, and the services file of the
+	// repository lists the services of the place rather than a default list
+	// of common services.
+	Place string
+	// Force causes an existing project rule file to be replaced.
+	Force bool
+}
+
+// InitRepo makes opt.Repo into a repository. The project metadata directory
+// is created, the project rule file and services file are written, and lines
+// that ignore generated files are added to the .gitignore file of the
+// repository. An existing services file is not replaced.
+// ErrRepoExists is returned if the rule file already exists, unless
+// iopt.Force is set. iopt may be nil.
+func InitRepo(opt *Options, iopt *InitOptions) error {
+	if iopt == nil {
+		iopt = &InitOptions{}
+	}
+	path := projectRulePath(opt.Repo)
+	if _, err := os.Stat(path); err == nil && !iopt.Force {
+		return ErrRepoExists
+	}
+
+	preset := iopt.Preset
+	if preset == "" {
+		preset = DefaultPreset
+	}
+	if _, ok := Preset(preset); !ok {
+		return fmt.Errorf("unknown preset %q", preset)
+	}
+	rules := []byte(fmt.Sprintf("# Rules that follow take precedence over the rules of the preset.\npreset %s\n", preset))
+	services := classList(defaultServices)
+	if iopt.Place != "" {
+		place, err := decodePlaceFile(filepath.Join(opt.Repo, iopt.Place), opt.API)
+		if err != nil {
+			return &ErrFile{FileName: iopt.Place, Errors: []error{err}}
+		}
+		rules = DeriveRules(place)
+		if s := placeServices(place); s != nil {
+			services = s
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, rules, 0666); err != nil {
+		return err
+	}
+	if err := writeServices(opt.Repo, services); err != nil {
+		return err
+	}
+	return updateGitignore(opt.Repo)
+}
+
+// DeriveRules returns the content of a rule file suited to the objects within
+// place. The rules extend the minimal preset, so that services that have
+// children, and folders, are written as directories, as are any scripts, with
+// their source in source.lua. All other objects are written to rbxmx files. A
+// comment lists the number of each class of object within the place.
+func DeriveRules(place *rbxfile.Root) []byte {
+	counts := map[string]int{}
+	var count func(obj *rbxfile.Instance)
+	count = func(obj *rbxfile.Instance) {
+		counts[obj.ClassName]++
+		for _, child := range obj.Children {
+			count(child)
+		}
+	}
+	for _, obj := range place.Instances {
+		count(obj)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Derived from the following classes:\n")
+	classes := make([]string, 0, len(counts))
+	for class := range counts {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if counts[classes[i]] != counts[classes[j]] {
+			return counts[classes[i]] > counts[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	for _, class := range classes {
+		fmt.Fprintf(&buf, "#\t%s: %d\n", class, counts[class])
+	}
+
+	buf.WriteString("\npreset minimal\n")
+
+	var dirs []string
+	seen := map[string]bool{}
+	for _, obj := range place.Instances {
+		if len(obj.Children) > 0 && !seen[obj.ClassName] {
+			seen[obj.ClassName] = true
+			dirs = append(dirs, obj.ClassName)
+		}
+	}
+	if counts["Folder"] > 0 && !seen["Folder"] {
+		dirs = append(dirs, "Folder")
+	}
+	if len(dirs) > 0 {
+		buf.WriteString("\n# Write services and folders as directories.\n")
+		for _, class := range dirs {
+			fmt.Fprintf(&buf, "out Child(%s) : Directory()\n", class)
+		}
+		buf.WriteString("in Directory(*, *) : Children()\n")
+	}
+
+	var scripts []string
+	for _, class := range scriptClasses {
+		if counts[class] > 0 {
+			scripts = append(scripts, class)
+		}
+	}
+	if len(scripts) > 0 {
+		buf.WriteString("\n# Write scripts as directories, with the source in source.lua.\n")
+		for _, class := range scripts {
+			fmt.Fprintf(&buf, "out Child(%s) : Directory()\n", class)
+		}
+		if len(dirs) == 0 {
+			buf.WriteString("in Directory(*, *) : Children()\n")
+		}
+		buf.WriteString("out Property(*, Source, ProtectedString) : File(source.lua)\n")
+		buf.WriteString("in File(source.lua) : Property(Source)\n")
+	}
+	return buf.Bytes()
+}
+
+// placeServices returns an API containing a class for each service at the
+// top level of place, or nil if there are no services.
+func placeServices(place *rbxfile.Root) *rbxapi.API {
+	var classes []string
+	for _, obj := range place.Instances {
+		if obj.IsService {
+			classes = append(classes, obj.ClassName)
+		}
+	}
+	if len(classes) == 0 {
+		return nil
+	}
+	return classList(classes)
+}
+
+// classList returns an API containing a class for each name in classes.
+func classList(classes []string) *rbxapi.API {
+	api := &rbxapi.API{Classes: make(map[string]*rbxapi.Class, len(classes))}
+	for _, class := range classes {
+		api.Classes[class] = &rbxapi.Class{Name: class}
+	}
+	return api
+}
+
+// writeServices writes services to the services file of the repository, if
+// the file does not already exist.
+func writeServices(repo string, services *rbxapi.API) error {
+	path := filepath.Join(repo, ProjectMetaDir, "services")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := dump.Encode(f, services); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// updateGitignore adds each of gitignoreLines that is missing from the
+// .gitignore file of the repository.
+func updateGitignore(repo string) error {
+	path := filepath.Join(repo, ".gitignore")
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	have := map[string]bool{}
+	for _, line := range strings.Split(string(b), "\n") {
+		have[strings.TrimSpace(line)] = true
+	}
+	var buf bytes.Buffer
+	buf.Write(b)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	for _, line := range gitignoreLines {
+		if !have[line] {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	if buf.Len() == len(b) {
+		return nil
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// LoadRules returns the rules that apply to every place and directory of the
+// repository: the global rules followed by the project rules.
+func LoadRules(opt *Options) ([]RulePair, error) {
+	return getStdRules(opt)
+}
@@ -0,0 +1,329 @@
+package rbxfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Severity indicates the severity of a Diagnostic.
+type Severity byte
+
+const (
+	// SeverityError indicates that a rule file cannot be used.
+	SeverityError Severity = iota
+	// SeverityWarning indicates a rule that is valid, but likely a mistake.
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return ""
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Diagnostic is a problem found within a rule file.
+type Diagnostic struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	// Column and EndColumn indicate the span of bytes within the line to
+	// which the diagnostic applies, starting at 1. EndColumn is exclusive.
+	// Both are 0 if the span is unknown.
+	Column    int      `json:"column"`
+	EndColumn int      `json:"end_column"`
+	Severity  Severity `json:"severity"`
+	Message   string   `json:"message"`
+	// Suggestion is a possible replacement for the text within the span.
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	pos := fmt.Sprintf("%s:%d", d.File, d.Line)
+	if d.Column > 0 {
+		pos = fmt.Sprintf("%s:%d", pos, d.Column)
+	}
+	s := fmt.Sprintf("%s: %s: %s", pos, d.Severity, d.Message)
+	if d.Suggestion != "" {
+		s += fmt.Sprintf(" (did you mean %q?)", d.Suggestion)
+	}
+	return s
+}
+
+// LintRuleFile parses the rule file at path with the given definitions, and
+// returns any problems found. If defs is nil, then DefaultRuleDefs is used.
+// An error is returned only if the file could not be read.
+func LintRuleFile(defs *FuncDef, path string) ([]Diagnostic, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LintRules(defs, path, f), nil
+}
+
+// LintRules parses rules read from r with the given definitions, and returns
+// any problems found. name is the name of the file from which the rules are
+// read, and is used to resolve included files. If defs is nil, then
+// DefaultRuleDefs is used.
+//
+// In addition to syntax errors, the following are reported as warnings:
+//
+//   - Rules shadowed by later rules that match the same items.
+//   - Out rules that write files that are not read by any in rule.
+//   - In rules that read files that are not written by any out rule.
+//
+// Rules of presets are not reported as unpaired, since a preset may leave
+// pairing to the rules that use it.
+func LintRules(defs *FuncDef, name string, r io.Reader) []Diagnostic {
+	p := &ruleParser{defs: defs, r: r, file: name}
+	if p.defs == nil {
+		p.defs = DefaultRuleDefs
+	}
+	if name != "" {
+		if abs, err := filepath.Abs(name); err == nil {
+			p.stack = []string{abs}
+		}
+	}
+	p.parseRules()
+
+	var diags []Diagnostic
+	for _, err := range p.errs {
+		d := Diagnostic{
+			File:      err.File,
+			Line:      err.Line,
+			Column:    err.Column,
+			EndColumn: err.EndColumn,
+			Severity:  SeverityError,
+			Message:   err.Err.Error(),
+		}
+		if e, ok := err.Err.(errUnknownFunc); ok {
+			d.Message = fmt.Sprintf("unknown function %q", e.Name)
+			d.Suggestion = e.Suggestion
+		}
+		diags = append(diags, d)
+	}
+	diags = append(diags, lintShadowed(p.defs, p.funcs, p.pos)...)
+	diags = append(diags, lintUnpaired(p.funcs, p.pos)...)
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Column < diags[j].Column
+	})
+	return diags
+}
+
+// argCovers returns whether argument b matches everything matched by
+// argument a.
+func argCovers(b, a Arg) bool {
+	if b.String() == a.String() {
+		return true
+	}
+	switch b := b.(type) {
+	case ArgName:
+		return b.Any
+	case ArgClass:
+		return b.Name.Any
+	case ArgFileName:
+		a, ok := a.(ArgFileName)
+		return ok && !strings.Contains(string(a), "*") && b.Match(string(a))
+	}
+	return false
+}
+
+// patternCovers returns whether pattern b matches everything matched by
+// pattern a.
+func patternCovers(b, a RuleFunc) bool {
+	if b.Name != a.Name || len(b.Args) != len(a.Args) {
+		return false
+	}
+	for i := range b.Args {
+		if !argCovers(b.Args[i], a.Args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lintShadowed reports rules whose items are all matched by a later rule. A
+// later out rule whose filter may reject items does not shadow, since
+// rejected items fall back to earlier rules.
+func lintShadowed(defs *FuncDef, rules []RulePair, pos []rulePos) (diags []Diagnostic) {
+	for i, a := range rules {
+		for j := i + 1; j < len(rules); j++ {
+			b := rules[j]
+			if a.SyncType != b.SyncType || b.Depth < a.Depth {
+				continue
+			}
+			if b.SyncType == SyncOut && defs.OutFilter[b.Filter.Name].MayReject {
+				continue
+			}
+			if !patternCovers(b.Pattern, a.Pattern) {
+				continue
+			}
+			diags = append(diags, Diagnostic{
+				File:      pos[i].File,
+				Line:      pos[i].Line,
+				Column:    pos[i].Start + 1,
+				EndColumn: pos[i].End + 1,
+				Severity:  SeverityWarning,
+				Message:   fmt.Sprintf("rule is shadowed by rule at %s:%d, which matches the same items", pos[j].File, pos[j].Line),
+			})
+			break
+		}
+	}
+	return diags
+}
+
+// propertyFileMatches returns whether a file name pattern matches the files
+// written by the PropertyName out filter with the given extension.
+func propertyFileMatches(pattern ArgFileName, ext string) bool {
+	return pattern.Match("."+ext) || strings.HasSuffix(string(pattern), "."+ext)
+}
+
+// lintUnpaired reports out rules and in rules using the default patterns and
+// filters that do not have a corresponding rule of the opposite type.
+func lintUnpaired(rules []RulePair, pos []rulePos) (diags []Diagnostic) {
+	// Returns whether an in rule reads what an out rule writes.
+	reads := func(in, out RulePair) bool {
+		if in.Filter.Name == "Ignore" {
+			return false
+		}
+		switch out.Filter.Name {
+		case "File":
+			if in.Pattern.Name != "File" || len(out.Filter.Args) != 1 || len(in.Pattern.Args) != 1 {
+				return false
+			}
+			pattern, ok := in.Pattern.Args[0].(ArgFileName)
+			return ok && pattern.Match(out.Filter.Args[0].String())
+		case "PropertyName":
+			if in.Pattern.Name != "File" || len(out.Filter.Args) != 1 || len(in.Pattern.Args) != 1 {
+				return false
+			}
+			pattern, ok := in.Pattern.Args[0].(ArgFileName)
+			return ok && propertyFileMatches(pattern, strings.ToLower(out.Filter.Args[0].String()))
+		case "Directory":
+			return in.Pattern.Name == "Directory"
+		}
+		return false
+	}
+
+	for i, out := range rules {
+		if out.SyncType != SyncOut || pos[i].Preset {
+			continue
+		}
+		switch out.Filter.Name {
+		case "File", "PropertyName", "Directory":
+		default:
+			continue
+		}
+		found := false
+		for _, in := range rules {
+			if in.SyncType == SyncIn && reads(in, out) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diags = append(diags, Diagnostic{
+				File:      pos[i].File,
+				Line:      pos[i].Line,
+				Column:    pos[i].FilterStart + 1,
+				EndColumn: pos[i].FilterEnd + 1,
+				Severity:  SeverityWarning,
+				Message:   "no in rule reads what is written by this rule",
+			})
+		}
+	}
+
+	for i, in := range rules {
+		if in.SyncType != SyncIn || in.Filter.Name == "Ignore" || pos[i].Preset {
+			continue
+		}
+		switch in.Pattern.Name {
+		case "File", "Directory":
+		default:
+			continue
+		}
+		found := false
+		for _, out := range rules {
+			if out.SyncType == SyncOut && reads(in, out) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diags = append(diags, Diagnostic{
+				File:      pos[i].File,
+				Line:      pos[i].Line,
+				Column:    pos[i].PatternStart + 1,
+				EndColumn: pos[i].PatternEnd + 1,
+				Severity:  SeverityWarning,
+				Message:   "no out rule writes what is read by this rule",
+			})
+		}
+	}
+	return diags
+}
+
+// nearestName returns the name within names that is most similar to name, or
+// an empty string if no name is similar enough.
+func nearestName(name string, names []string) string {
+	best := ""
+	bestDist := len(name)/2 + 1
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return n
+		}
+		if d := editDistance(strings.ToLower(name), strings.ToLower(n)); d < bestDist || (d == bestDist && best != "" && n < best) {
+			best, bestDist = n, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,52 @@
+package rbxfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestDirName is the name of the directory within the project metadata
+// directory that lists, for each place, the paths written by the last
+// sync-out of the place. Sync-out removes only listed paths, so that files
+// added by hand are never removed.
+const ManifestDirName = "manifests"
+
+func manifestPath(repo, place string) string {
+	return filepath.Join(repo, ProjectMetaDir, ManifestDirName, place)
+}
+
+// readManifest returns the paths listed by the manifest of place, relative to
+// the repository. No paths are returned if the place has no manifest.
+func readManifest(repo, place string) ([]string, error) {
+	b, err := ioutil.ReadFile(manifestPath(repo, place))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			paths = append(paths, filepath.FromSlash(line))
+		}
+	}
+	return paths, nil
+}
+
+// encodeManifest returns the content of a manifest listing paths.
+func encodeManifest(paths []string) []byte {
+	sorted := make([]string, len(paths))
+	copy(sorted, paths)
+	sort.Strings(sorted)
+	var buf bytes.Buffer
+	for _, path := range sorted {
+		buf.WriteString(filepath.ToSlash(path))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
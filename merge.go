@@ -0,0 +1,525 @@
+package rbxfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/robloxapi/rbxfile"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SnapshotDirName is the name of the directory within the project metadata
+// directory that contains the last synced state of each place. A snapshot is
+// written whenever the place file and its directory are known to agree: after
+// the place is synced out, or merged. Snapshots are named after the place
+// file, including its extension.
+const SnapshotDirName = "snapshots"
+
+// ErrNoSnapshot is returned when merging a place that has not been synced.
+var ErrNoSnapshot = errors.New("place has no snapshot; sync it first")
+
+func snapshotPath(repo, place string) string {
+	return filepath.Join(repo, ProjectMetaDir, SnapshotDirName, place)
+}
+
+// writeSnapshot records data as the last synced content of place.
+func writeSnapshot(opt *Options, place string, data []byte) error {
+	path := snapshotPath(opt.Repo, place)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	st, err := newStage(opt.Repo, "snapshot-")
+	if err != nil {
+		return err
+	}
+	defer st.remove()
+	if err := st.write(path, data); err != nil {
+		return err
+	}
+	return st.commit(path)
+}
+
+// readSnapshot decodes the last synced state of place.
+func readSnapshot(opt *Options, place string) (*rbxfile.Root, error) {
+	root, err := decodePlaceFile(snapshotPath(opt.Repo, place), opt.API)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSnapshot
+	}
+	return root, err
+}
+
+// MergeSide indicates a side of a merge.
+type MergeSide byte
+
+const (
+	// MergeNone indicates that a conflict is not resolved.
+	MergeNone MergeSide = iota
+	// MergePlace indicates the place file.
+	MergePlace
+	// MergeDir indicates the directory.
+	MergeDir
+)
+
+func (s MergeSide) String() string {
+	switch s {
+	case MergeNone:
+		return "none"
+	case MergePlace:
+		return "place"
+	case MergeDir:
+		return "dir"
+	}
+	return ""
+}
+
+func (s MergeSide) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Conflict is an instance or property changed differently by both sides of
+// a merge.
+type Conflict struct {
+	Path string `json:"path"`
+	// Property is the name of the conflicting property. If empty, then the
+	// conflict applies to the instance itself.
+	Property string `json:"property,omitempty"`
+	// Base, Place, and Dir describe the item in the snapshot, the place, and
+	// the directory. An empty string indicates that the item does not exist.
+	Base  string `json:"base,omitempty"`
+	Place string `json:"place,omitempty"`
+	Dir   string `json:"dir,omitempty"`
+	// Resolution is the side chosen for the conflict.
+	Resolution MergeSide `json:"resolution"`
+}
+
+func (c Conflict) String() string {
+	path := c.Path
+	if c.Property != "" {
+		path += "[" + c.Property + "]"
+	}
+	describe := func(s string) string {
+		if s == "" {
+			return "(none)"
+		}
+		return s
+	}
+	return fmt.Sprintf("%s: base %s; place %s; dir %s (%s)", path, describe(c.Base), describe(c.Place), describe(c.Dir), c.Resolution)
+}
+
+// MergeResolver chooses the side of a conflict to keep. Returning MergeNone
+// leaves the conflict unresolved.
+type MergeResolver func(c Conflict) MergeSide
+
+// PreferSide returns a MergeResolver that resolves every conflict with side.
+func PreferSide(side MergeSide) MergeResolver {
+	return func(Conflict) MergeSide { return side }
+}
+
+// Merge is the result of merging a place with its directory.
+type Merge struct {
+	Place string `json:"place"`
+	Dir   string `json:"dir"`
+	// FromPlace and FromDir list the changes made since the snapshot by the
+	// place and the directory, which are applied to the other side.
+	FromPlace []Difference `json:"from_place"`
+	FromDir   []Difference `json:"from_dir"`
+	Conflicts []Conflict   `json:"conflicts"`
+	// Applied is whether the merged result was written to both sides.
+	Applied bool `json:"applied"`
+}
+
+// Unresolved returns the number of conflicts that are not resolved.
+func (m *Merge) Unresolved() (n int) {
+	for _, c := range m.Conflicts {
+		if c.Resolution == MergeNone {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteReport writes a human-readable summary of the merge to w.
+func (m *Merge) WriteReport(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "merge `%s` <-> `%s`\n", m.Place, m.Dir); err != nil {
+		return err
+	}
+	for _, d := range m.FromPlace {
+		if _, err := fmt.Fprintf(w, "\tplace: %s\n", d); err != nil {
+			return err
+		}
+	}
+	for _, d := range m.FromDir {
+		if _, err := fmt.Fprintf(w, "\tdir:   %s\n", d); err != nil {
+			return err
+		}
+	}
+	for _, c := range m.Conflicts {
+		if _, err := fmt.Fprintf(w, "\tCONFLICT %s\n", c); err != nil {
+			return err
+		}
+	}
+	if !m.Applied {
+		_, err := fmt.Fprintf(w, "\tnot applied: %d unresolved conflicts\n", m.Unresolved())
+		return err
+	}
+	return nil
+}
+
+// MergeRepo merges each place in placeNames with its directory, using the
+// state recorded by the last sync as the common base. Changes made on only
+// one side are applied to the other side. Each conflict is passed to
+// resolve, which may be nil. If any conflict of a place remains unresolved,
+// then neither side of the place is modified. If placeNames is empty, then
+// all places in the repository are merged.
+func MergeRepo(opt *Options, placeNames []string, resolve MergeResolver) ([]*Merge, error) {
+	rules, placeNames, err := loadRepo(opt, placeNames, getPlacesInRepo)
+	if err != nil {
+		return nil, err
+	}
+	outRules := filterRuleType(rules, SyncOut)
+	inRules := filterRuleType(rules, SyncIn)
+
+	// Leftovers from an interrupted sync are no longer useful.
+	if err := cleanStaging(opt.Repo); err != nil {
+		getReporter(opt).Report(Event{Kind: EventWarning, Err: err})
+	}
+
+	results := make([]*Merge, len(placeNames))
+	kept, err := eachName(opt, placeNames, func(i int, opt *Options) (ok bool, err error) {
+		results[i], err = mergePlace(opt, placeNames[i], outRules, inRules, resolve)
+		return results[i] != nil, err
+	})
+	out := make([]*Merge, len(kept))
+	for j, i := range kept {
+		out[j] = results[i]
+	}
+	return out, err
+}
+
+func mergePlace(opt *Options, name string, outRules, inRules []RulePair, resolve MergeResolver) (*Merge, error) {
+	dir := getPlaceDir(name)
+	result := &Merge{Place: name, Dir: dir}
+
+	base, err := readSnapshot(opt, name)
+	if err != nil {
+		return nil, err
+	}
+	// The directory is compared with the snapshot as it would be synced in,
+	// so that content not mapped by the rules is not seen as removed by the
+	// directory.
+	dirBase, err := readSnapshot(opt, name)
+	if err != nil {
+		return nil, err
+	}
+	if dirBase, err = syncRoundTrip(opt, name, dirBase, outRules, inRules); err != nil {
+		return nil, err
+	}
+	place, err := decodePlaceFile(filepath.Join(opt.Repo, name), opt.API)
+	if err != nil {
+		return nil, err
+	}
+	sources := &SourceCache{}
+	refs := map[string]*rbxfile.Instance{}
+	inActions, err := syncInReadDir(opt, sources, dir, []string{}, inRules, refs, nil)
+	if err != nil {
+		return nil, err
+	}
+	tree := syncInBuildRoot(opt, refs, sources, syncInAnalyzeActions(inActions, nil))
+
+	m := &merger{result: result, resolve: resolve}
+	merged := &rbxfile.Root{Instances: m.children("", base.Instances, dirBase.Instances, place.Instances, tree.Instances)}
+	fixReferences(merged)
+	if result.Unresolved() > 0 {
+		return result, nil
+	}
+
+	var buf bytes.Buffer
+	if err := encodePlaceFile(&buf, name, opt.API, merged); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	// Write the directory first, since the place may be open elsewhere.
+	outActions, err := syncOutReadRoot(opt, merged, name, outRules, nil)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := syncOutPlanActions(opt, name, dir, merged, syncOutAnalyzeActions(outActions, nil))
+	if err != nil {
+		return nil, err
+	}
+	if err := syncOutApplyActions(opt, plan); err != nil {
+		return nil, err
+	}
+	st, err := newStage(opt.Repo, "merge-")
+	if err != nil {
+		return nil, err
+	}
+	defer st.remove()
+	path := filepath.Join(opt.Repo, name)
+	if err := st.write(path, data); err != nil {
+		return nil, err
+	}
+	if err := st.commit(path); err != nil {
+		return nil, err
+	}
+	if err := writeSnapshot(opt, name, data); err != nil {
+		return nil, err
+	}
+	result.Applied = true
+	return result, nil
+}
+
+// merger builds a tree from the changes of both sides of a merge.
+type merger struct {
+	result  *Merge
+	resolve MergeResolver
+}
+
+// conflict records a conflict, and returns the side chosen to resolve it.
+func (m *merger) conflict(c Conflict) MergeSide {
+	if m.resolve != nil {
+		c.Resolution = m.resolve(c)
+	}
+	m.result.Conflicts = append(m.result.Conflicts, c)
+	return c.Resolution
+}
+
+// childKeys returns a key for each child that identifies it among its
+// siblings by name, and by position among siblings of the same name.
+func childKeys(children []*rbxfile.Instance) (keys []string, index map[string]*rbxfile.Instance) {
+	keys = make([]string, len(children))
+	index = make(map[string]*rbxfile.Instance, len(children))
+	count := map[string]int{}
+	for i, child := range children {
+		name := child.Name()
+		key := name
+		if n := count[name]; n > 0 {
+			key = fmt.Sprintf("%s#%d", name, n)
+		}
+		count[name]++
+		keys[i] = key
+		index[key] = child
+	}
+	return keys, index
+}
+
+// treesEqual returns whether two instances and their descendants are
+// structurally equal.
+func treesEqual(a, b *rbxfile.Instance) bool {
+	var c comparer
+	c.instance("", a, b)
+	return len(c.diffs) == 0 && len(c.removed) == 0 && len(c.added) == 0
+}
+
+// children merges lists of children from each side, returning the merged
+// list. The place is compared with base, and the directory with dirBase.
+// Children are ordered as in the place, followed by children that exist
+// only in the directory.
+func (m *merger) children(path string, base, dirBase, place, dir []*rbxfile.Instance) []*rbxfile.Instance {
+	_, bindex := childKeys(base)
+	_, bdindex := childKeys(dirBase)
+	pkeys, pindex := childKeys(place)
+	dkeys, dindex := childKeys(dir)
+	keys := append([]string{}, pkeys...)
+	for _, key := range dkeys {
+		if _, ok := pindex[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	var merged []*rbxfile.Instance
+	for _, key := range keys {
+		b, bd, p, d := bindex[key], bdindex[key], pindex[key], dindex[key]
+		var obj *rbxfile.Instance
+		if p != nil {
+			obj = p
+		} else {
+			obj = d
+		}
+		childPath := joinPath(path, obj.Name())
+		switch {
+		case p != nil && d != nil:
+			merged = append(merged, m.instance(childPath, b, bd, p, d))
+		case p != nil && bd == nil:
+			// Not in the directory, which is a change only if the directory
+			// had it.
+			if b == nil {
+				m.result.FromPlace = append(m.result.FromPlace, Difference{Kind: DiffAdded, Path: childPath, New: p.ClassName})
+			}
+			merged = append(merged, p.Clone())
+		case d != nil && b == nil:
+			m.result.FromDir = append(m.result.FromDir, Difference{Kind: DiffAdded, Path: childPath, New: d.ClassName})
+			merged = append(merged, d.Clone())
+		case p != nil:
+			// Removed from the directory.
+			if b != nil && treesEqual(b, p) {
+				m.result.FromDir = append(m.result.FromDir, Difference{Kind: DiffRemoved, Path: childPath, Old: bd.ClassName})
+				continue
+			}
+			c := Conflict{Path: childPath, Base: bd.ClassName, Place: p.ClassName + " (modified)"}
+			if b == nil {
+				c.Place = p.ClassName
+			}
+			if m.conflict(c) != MergeDir {
+				merged = append(merged, p.Clone())
+			}
+		case d != nil:
+			// Removed from the place.
+			if bd != nil && treesEqual(bd, d) {
+				m.result.FromPlace = append(m.result.FromPlace, Difference{Kind: DiffRemoved, Path: childPath, Old: b.ClassName})
+				continue
+			}
+			c := Conflict{Path: childPath, Base: b.ClassName, Dir: d.ClassName + " (modified)"}
+			if bd == nil {
+				c.Dir = d.ClassName
+			}
+			if m.conflict(c) != MergePlace {
+				merged = append(merged, d.Clone())
+			}
+		}
+	}
+	return merged
+}
+
+// instance merges an instance that exists on both sides. The place is
+// compared with b, and the directory with bd. Either is nil if the instance
+// was added by the side.
+func (m *merger) instance(path string, b, bd, p, d *rbxfile.Instance) *rbxfile.Instance {
+	class := p.ClassName
+	if p.ClassName != d.ClassName {
+		switch {
+		case bd != nil && bd.ClassName == d.ClassName:
+			if b == nil || b.ClassName != p.ClassName {
+				m.result.FromPlace = append(m.result.FromPlace, Difference{Kind: DiffChanged, Path: path, Old: d.ClassName, New: p.ClassName})
+			}
+		case b != nil && b.ClassName == p.ClassName:
+			m.result.FromDir = append(m.result.FromDir, Difference{Kind: DiffChanged, Path: path, Old: p.ClassName, New: d.ClassName})
+			class = d.ClassName
+		default:
+			c := Conflict{Path: path, Place: p.ClassName, Dir: d.ClassName}
+			if b != nil {
+				c.Base = b.ClassName
+			}
+			if m.conflict(c) == MergeDir {
+				class = d.ClassName
+			}
+		}
+	}
+
+	obj := rbxfile.NewInstance(class, nil)
+	obj.Reference = p.Reference
+	obj.IsService = p.IsService || d.IsService
+
+	var bprops, bdprops map[string]rbxfile.Value
+	var bchildren, bdchildren []*rbxfile.Instance
+	if b != nil {
+		bprops = b.Properties
+		bchildren = b.Children
+	}
+	if bd != nil {
+		bdprops = bd.Properties
+		bdchildren = bd.Children
+	}
+	names := make([]string, 0, len(p.Properties)+len(d.Properties))
+	seen := map[string]bool{}
+	for _, props := range []map[string]rbxfile.Value{bprops, p.Properties, d.Properties} {
+		for name := range props {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	eq := func(a, b rbxfile.Value) bool {
+		if a == nil || b == nil {
+			return a == nil && b == nil
+		}
+		return valuesEqual(a, b)
+	}
+	describe := func(v rbxfile.Value) string {
+		if v == nil {
+			return ""
+		}
+		return describeValue(v)
+	}
+	diff := func(old, new rbxfile.Value, property string) Difference {
+		d := Difference{Kind: DiffChanged, Path: path, Property: property, Old: describe(old), New: describe(new)}
+		if old == nil {
+			d.Kind = DiffAdded
+		} else if new == nil {
+			d.Kind = DiffRemoved
+		}
+		return d
+	}
+	for _, name := range names {
+		vb, vbd, vp, vd := bprops[name], bdprops[name], p.Properties[name], d.Properties[name]
+		var v rbxfile.Value
+		switch {
+		case eq(vp, vd):
+			v = vp
+		case eq(vd, vbd):
+			// Includes properties that are not mapped by the rules.
+			if !eq(vp, vb) {
+				m.result.FromPlace = append(m.result.FromPlace, diff(vd, vp, name))
+			}
+			v = vp
+		case eq(vp, vb):
+			m.result.FromDir = append(m.result.FromDir, diff(vp, vd, name))
+			v = vd
+		default:
+			v = vp
+			c := Conflict{Path: path, Property: name, Base: describe(vb), Place: describe(vp), Dir: describe(vd)}
+			if m.conflict(c) == MergeDir {
+				v = vd
+			}
+		}
+		if v != nil {
+			obj.Properties[name] = v.Copy()
+		}
+	}
+
+	for _, child := range m.children(path, bchildren, bdchildren, p.Children, d.Children) {
+		obj.AddChild(child)
+	}
+	return obj
+}
+
+// fixReferences replaces each reference within root to an instance outside
+// of root with the instance of the same path within root, or with an empty
+// reference if there is no such instance.
+func fixReferences(root *rbxfile.Root) {
+	paths := map[string]*rbxfile.Instance{}
+	var index func(*rbxfile.Instance)
+	index = func(obj *rbxfile.Instance) {
+		path := fullPath(obj)
+		if _, ok := paths[path]; !ok {
+			paths[path] = obj
+		}
+		for _, child := range obj.Children {
+			index(child)
+		}
+	}
+	var fix func(*rbxfile.Instance)
+	fix = func(obj *rbxfile.Instance) {
+		for name, value := range obj.Properties {
+			if ref, ok := value.(rbxfile.ValueReference); ok && ref.Instance != nil {
+				obj.Properties[name] = rbxfile.ValueReference{Instance: paths[fullPath(ref.Instance)]}
+			}
+		}
+		for _, child := range obj.Children {
+			fix(child)
+		}
+	}
+	for _, obj := range root.Instances {
+		index(obj)
+	}
+	for _, obj := range root.Instances {
+		fix(obj)
+	}
+}
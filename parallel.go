@@ -0,0 +1,187 @@
+package rbxfs
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+func getWorkers(opt *Options) int {
+	if opt == nil || opt.Workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return opt.Workers
+}
+
+func getFileWorkers(opt *Options) int {
+	if opt == nil || opt.FileWorkers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return opt.FileWorkers
+}
+
+// forEach calls f for each index in [0, n), running up to workers calls
+// concurrently. Returns after every call has finished.
+func forEach(workers, n int, f func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// eventBuffer is a Reporter that records events, so that they can be passed
+// on later in a deterministic order.
+type eventBuffer struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (b *eventBuffer) Report(e Event) {
+	b.mu.Lock()
+	b.events = append(b.events, e)
+	b.mu.Unlock()
+}
+
+// syncEach calls f for each index in [0, n), running up to getWorkers(opt)
+// calls concurrently. Each call receives a copy of opt whose Reporter
+// buffers events. Once a call, and the calls of every lower index, have
+// finished, its events are passed to the reporter of opt, so that events are
+// always reported in index order.
+//
+// If f returns false and opt.FailFast is set, then no further calls are
+// started. Calls that have already started are allowed to finish.
+func syncEach(opt *Options, n int, f func(i int, opt *Options) bool) {
+	if n == 0 {
+		return
+	}
+	workers := getWorkers(opt)
+	if workers > n {
+		workers = n
+	}
+	reporter := getReporter(opt)
+
+	bufs := make([]*eventBuffer, n)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		bufs[i] = &eventBuffer{}
+		done[i] = make(chan struct{})
+	}
+
+	var stop int32
+	next := make(chan int)
+	go func() {
+		for i := 0; i < n; i++ {
+			if atomic.LoadInt32(&stop) != 0 {
+				for ; i < n; i++ {
+					close(done[i])
+				}
+				break
+			}
+			next <- i
+		}
+		close(next)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				o := *opt
+				o.Reporter = bufs[i]
+				if !f(i, &o) && opt.FailFast {
+					atomic.StoreInt32(&stop, 1)
+				}
+				close(done[i])
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		<-done[i]
+		for _, e := range bufs[i].events {
+			reporter.Report(e)
+		}
+	}
+	wg.Wait()
+}
+
+// loadRepo checks that opt.Repo is a repository, and returns the global and
+// project rules. If names is empty, then it is filled by calling list with
+// the repository. ErrNoFiles is returned if there are no names.
+func loadRepo(opt *Options, names []string, list func(repo string) []string) (rules []RulePair, _ []string, err error) {
+	if !pathIsRepo(opt.Repo) {
+		return nil, nil, ErrNotRepo
+	}
+	if rules, err = getStdRules(opt); err != nil {
+		return nil, nil, err
+	}
+	if len(names) == 0 {
+		names = list(opt.Repo)
+	}
+	if len(names) == 0 {
+		return nil, nil, ErrNoFiles
+	}
+	return rules, names, nil
+}
+
+// eachName calls f for each index of names with syncEach. Each name is a
+// place or directory, which are independent of each other, so they are
+// processed concurrently. The errors returned by f are collected in order
+// into an ErrsFile. If opt.FailFast is set, then collection stops at the
+// first error.
+//
+// f returns whether it produced a result for the name, which may be the case
+// even if it also returned an error. Returns the indexes of the names that
+// have a result, in order, leaving out any names after the first error when
+// opt.FailFast is set. A caller collects the result of each name into a slice
+// by index, and then keeps the results of the returned indexes, so that
+// results are in a deterministic order.
+func eachName(opt *Options, names []string, f func(i int, opt *Options) (ok bool, err error)) (kept []int, err error) {
+	oks := make([]bool, len(names))
+	nameErrs := make([]error, len(names))
+	syncEach(opt, len(names), func(i int, opt *Options) bool {
+		oks[i], nameErrs[i] = f(i, opt)
+		return nameErrs[i] == nil
+	})
+
+	errs := ErrsFile{}
+	for i, e := range nameErrs {
+		if oks[i] {
+			kept = append(kept, i)
+		}
+		if e == nil {
+			continue
+		}
+		errs = appendErrFile(errs, names[i], e)
+		if opt.FailFast {
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return kept, errs
+	}
+	return kept, nil
+}
@@ -0,0 +1,205 @@
+package rbxfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PlanOp is an operation to be performed on a file or directory.
+type PlanOp byte
+
+const (
+	// PlanNone indicates that the file would not be changed.
+	PlanNone PlanOp = iota
+	// PlanCreate indicates that the file would be created.
+	PlanCreate
+	// PlanModify indicates that the content of an existing file would be
+	// replaced.
+	PlanModify
+	// PlanDelete indicates that the file would be removed.
+	PlanDelete
+)
+
+func (op PlanOp) String() string {
+	switch op {
+	case PlanNone:
+		return "none"
+	case PlanCreate:
+		return "create"
+	case PlanModify:
+		return "modify"
+	case PlanDelete:
+		return "delete"
+	}
+	return ""
+}
+
+func (op PlanOp) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+// PlanItem is an operation on a single file or directory.
+type PlanItem struct {
+	Op PlanOp `json:"op"`
+	// Path is the path of the file, relative to the repository.
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+	// Instances contains the paths of the instances from which the content
+	// of the file is derived.
+	Instances []string `json:"instances,omitempty"`
+	// Size is the size of the content to be written, in bytes.
+	Size int64 `json:"size"`
+
+	data []byte
+}
+
+// Plan describes the changes made to files by syncing a single place or
+// directory.
+type Plan struct {
+	SyncType SyncType `json:"-"`
+	// Name is the name of the place when syncing out, or the directory when
+	// syncing in.
+	Name string `json:"name"`
+	// Target is the directory written when syncing out, or the place file
+	// written when syncing in. It is relative to the repository.
+	Target string     `json:"target"`
+	Items  []PlanItem `json:"items"`
+
+	// Paths recorded in the manifest of the place once a sync-out plan is
+	// applied.
+	manifest []string
+}
+
+// PlanStats counts the items of a plan by operation.
+type PlanStats struct {
+	Unchanged int `json:"unchanged"`
+	Created   int `json:"created"`
+	Modified  int `json:"modified"`
+	Deleted   int `json:"deleted"`
+}
+
+func (s PlanStats) String() string {
+	return fmt.Sprintf("%d created, %d modified, %d deleted, %d unchanged", s.Created, s.Modified, s.Deleted, s.Unchanged)
+}
+
+// add counts an item with the given operation.
+func (s *PlanStats) add(op PlanOp) {
+	switch op {
+	case PlanNone:
+		s.Unchanged++
+	case PlanCreate:
+		s.Created++
+	case PlanModify:
+		s.Modified++
+	case PlanDelete:
+		s.Deleted++
+	}
+}
+
+// Stats returns the number of items in the plan for each operation.
+func (p *Plan) Stats() (s PlanStats) {
+	for _, item := range p.Items {
+		s.add(item.Op)
+	}
+	return s
+}
+
+// Changes returns the items of the plan that would change a file.
+func (p *Plan) Changes() []PlanItem {
+	var items []PlanItem
+	for _, item := range p.Items {
+		if item.Op != PlanNone {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// HasChanges returns whether applying the plan would change any files.
+func (p *Plan) HasChanges() bool {
+	for _, item := range p.Items {
+		if item.Op != PlanNone {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteReport writes a human-readable summary of the changes in the plan to
+// w.
+func (p *Plan) WriteReport(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "sync-%s %q -> %q\n", p.SyncType, p.Name, p.Target); err != nil {
+		return err
+	}
+	for _, item := range p.Items {
+		if item.Op == PlanNone {
+			continue
+		}
+		var err error
+		switch {
+		case item.IsDir:
+			_, err = fmt.Fprintf(w, "\t%-6s dir  %s\n", item.Op, item.Path)
+		case item.Op == PlanDelete:
+			_, err = fmt.Fprintf(w, "\t%-6s file %s\n", item.Op, item.Path)
+		default:
+			_, err = fmt.Fprintf(w, "\t%-6s file %s (%d bytes)\n", item.Op, item.Path, item.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "\t%s\n", p.Stats())
+	return err
+}
+
+// newDirItem returns an item for a directory, comparing it against the
+// current state of the repository.
+func newDirItem(repo, path string, instances []string) PlanItem {
+	item := PlanItem{Op: PlanCreate, Path: path, IsDir: true, Instances: instances}
+	if stat, err := os.Stat(filepath.Join(repo, path)); err == nil && stat.IsDir() {
+		item.Op = PlanNone
+	}
+	return item
+}
+
+// newFileItem returns an item for a file with the given content, comparing
+// it against the current state of the repository.
+func newFileItem(repo, path string, instances []string, data []byte) PlanItem {
+	item := PlanItem{Op: PlanCreate, Path: path, Instances: instances, Size: int64(len(data)), data: data}
+	if b, err := ioutil.ReadFile(filepath.Join(repo, path)); err == nil {
+		if bytes.Equal(b, data) {
+			item.Op = PlanNone
+		} else {
+			item.Op = PlanModify
+		}
+	} else if !os.IsNotExist(err) {
+		item.Op = PlanModify
+	}
+	return item
+}
+
+// addDir adds a directory to the plan.
+func (p *Plan) addDir(repo, path string, instances []string) {
+	p.Items = append(p.Items, newDirItem(repo, path, instances))
+}
+
+// addFile adds a file with the given content to the plan.
+func (p *Plan) addFile(repo, path string, instances []string, data []byte) {
+	p.Items = append(p.Items, newFileItem(repo, path, instances, data))
+}
+
+// PlanOut determines the changes that SyncOutReadRepo would make to the
+// repository, without modifying any files.
+func PlanOut(opt *Options, placeNames []string) ([]*Plan, error) {
+	return syncOutRepo(opt, placeNames, false)
+}
+
+// PlanIn determines the changes that SyncInReadRepo would make to the
+// repository, without modifying any files.
+func PlanIn(opt *Options, dirNames []string) ([]*Plan, error) {
+	return syncInRepo(opt, dirNames, false)
+}
@@ -0,0 +1,112 @@
+package rbxfs
+
+import (
+	"sort"
+)
+
+// DefaultPreset is the name of the preset used by InitRepo when no preset is
+// given.
+const DefaultPreset = "scripts"
+
+// presets maps the name of each built-in preset to the content of its rule
+// file. A rule file uses a preset with a `preset <name>` line.
+var presets = map[string]string{
+	// Everything within a place is written to a single rbxmx file.
+	"minimal": `out Child(*) : File(children.rbxmx)
+in File(children.rbxmx) : Children()
+out Property(*, *) : File(properties.json)
+in File(properties.json) : Properties()
+`,
+
+	// Services and folders are written as directories, scripts are written
+	// as directories containing their source, and all other objects are
+	// written to rbxmx files. A script cannot be written as a single file,
+	// since a file holds either objects or a property, and not an object
+	// together with its Source.
+	"scripts": `preset minimal
+
+out Child(Workspace) : Directory()
+out Child(Lighting) : Directory()
+out Child(ReplicatedFirst) : Directory()
+out Child(ReplicatedStorage) : Directory()
+out Child(ServerScriptService) : Directory()
+out Child(ServerStorage) : Directory()
+out Child(StarterGui) : Directory()
+out Child(StarterPack) : Directory()
+out Child(StarterPlayer) : Directory()
+out Child(SoundService) : Directory()
+out Child(Teams) : Directory()
+out Child(Folder) : Directory()
+in Directory(*, *) : Children()
+
+out Child(Script) : Directory()
+out Child(LocalScript) : Directory()
+out Child(ModuleScript) : Directory()
+out Property(*, Source, ProtectedString) : File(source.lua)
+in File(source.lua) : Property(Source)
+`,
+
+	// Similar to scripts, except that the source of each script is written
+	// to an init file named after the kind of script, as in Rojo projects.
+	"rojo-like": `preset minimal
+
+out Child(Workspace) : Directory()
+out Child(Lighting) : Directory()
+out Child(ReplicatedFirst) : Directory()
+out Child(ReplicatedStorage) : Directory()
+out Child(ServerScriptService) : Directory()
+out Child(ServerStorage) : Directory()
+out Child(StarterGui) : Directory()
+out Child(StarterPack) : Directory()
+out Child(StarterPlayer) : Directory()
+out Child(SoundService) : Directory()
+out Child(Teams) : Directory()
+out Child(Folder) : Directory()
+in Directory(*, *) : Children()
+
+out Child(@Script) : Directory()
+out Child(@LocalScript) : Directory()
+out Child(@ModuleScript) : Directory()
+out Property(@Script, Source, ProtectedString) : File(init.server.lua)
+in File(init.server.lua) : Property(Source)
+out Property(@LocalScript, Source, ProtectedString) : File(init.client.lua)
+in File(init.client.lua) : Property(Source)
+out Property(@ModuleScript, Source, ProtectedString) : File(init.lua)
+in File(init.lua) : Property(Source)
+`,
+
+	// Every object is written as a directory. Objects with names that are
+	// not valid as directory names are written to rbxmx files instead.
+	"full-directory": `out Child(*) : File(children.rbxmx)
+in File(children.rbxmx) : Children()
+out Child(*) : Directory()
+in Directory(*, *) : Children()
+out Property(*, *) : File(properties.json)
+in File(properties.json) : Properties()
+out Property(*, Source, ProtectedString) : File(source.lua)
+in File(source.lua) : Property(Source)
+`,
+}
+
+// Presets returns the names of the built-in presets, in sorted order.
+func Presets() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Preset returns the content of the rule file of the built-in preset with the
+// given name, and whether the preset exists.
+func Preset(name string) (rules string, ok bool) {
+	rules, ok = presets[name]
+	return rules, ok
+}
+
+// presetFile returns the name used in place of a file name for the rules of
+// a preset.
+func presetFile(name string) string {
+	return "(preset " + name + ")"
+}
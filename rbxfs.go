@@ -7,11 +7,16 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 )
 
 const ProjectMetaDir = ".rbxfs"
 const RulesFileName = "rules"
 
+// DirRulesFileName is the name of the file containing the rules of a single
+// directory.
+const DirRulesFileName = ".rbxfsrules"
+
 var ErrNoFiles = errors.New("no files to sync")
 var ErrNotRepo = errors.New("directory is not a repository")
 
@@ -22,15 +27,62 @@ func pathIsRepo(path string) bool {
 	return true
 }
 
-func globalRulePath() string {
-	// $APPDATA/rbxfs/{RulesFileName}
+// ConfigEnv is the name of an environment variable that, when set, overrides
+// the location of the global configuration directory.
+const ConfigEnv = "RBXFS_CONFIG"
+
+// configDirName is the name of the directory within a per-user configuration
+// location that contains global configuration.
+const configDirName = "rbxfs"
+
+// GlobalConfigDir returns the directory containing the global configuration
+// for the current user. The directory is determined by the first of the
+// following that is set:
+//
+//   - opt.ConfigDir
+//   - $RBXFS_CONFIG
+//   - %APPDATA%\rbxfs (Windows only)
+//   - $XDG_CONFIG_HOME/rbxfs
+//   - $HOME/.config/rbxfs
+//
+// An empty string is returned if no location could be determined.
+func GlobalConfigDir(opt *Options) string {
+	if opt != nil && opt.ConfigDir != "" {
+		return opt.ConfigDir
+	}
+	if dir := os.Getenv(ConfigEnv); dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, configDirName)
+		}
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, configDirName)
+	}
+	if dir := os.Getenv("HOME"); dir != "" {
+		return filepath.Join(dir, ".config", configDirName)
+	}
 	return ""
 }
 
+func globalRulePath(opt *Options) string {
+	dir := GlobalConfigDir(opt)
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, RulesFileName)
+}
+
 func projectRulePath(path string) string {
 	return filepath.Join(path, ProjectMetaDir, RulesFileName)
 }
 
+func dirRulePath(path string) string {
+	return filepath.Join(path, DirRulesFileName)
+}
+
 func getPlacesInRepo(repo string) []string {
 	files, err := ioutil.ReadDir(repo)
 	if err != nil {
@@ -68,6 +120,38 @@ type Options struct {
 	Repo     string
 	RuleDefs *FuncDef
 	API      *rbxapi.API
+	// ConfigDir is the directory containing global configuration, such as
+	// global rules. If empty, the location is determined by GlobalConfigDir.
+	ConfigDir string
+	// Formats is used to determine the format of a file from its extension.
+	// If nil, then DefaultFormats is used.
+	Formats *FormatRegistry
+	// Reporter receives events describing the progress of sync operations.
+	// If nil, then events are discarded.
+	Reporter Reporter
+	// FailFast causes a sync operation to stop at the first error: places
+	// and directories that have not started are not synced, and only the
+	// first error of a failed place or directory is reported. Otherwise, the
+	// remaining places and directories continue to be synced, and every
+	// error found while encoding or staging the files of a failed one is
+	// collected.
+	//
+	// FailFast does not affect what is written for a failed place or
+	// directory: each is synced all-or-nothing. If any of its files cannot be
+	// encoded, staged, or moved into place, then the files already moved are
+	// restored, and its target is left unchanged.
+	FailFast bool
+	// KeepStale prevents sync-out from removing files and directories that
+	// were written by a previous sync-out, but are no longer produced from
+	// the place.
+	KeepStale bool
+	// Workers is the maximum number of places or directories that are synced
+	// concurrently. If 0 or less, then GOMAXPROCS is used.
+	Workers int
+	// FileWorkers is the maximum number of files that are encoded or decoded
+	// concurrently while syncing a single place or directory. If 0 or less,
+	// then GOMAXPROCS is used.
+	FileWorkers int
 }
 
 // ErrMux combines multiple errors into a single error. If there is more than
@@ -93,7 +177,10 @@ func (err ErrMux) Error() string {
 type ErrFile struct {
 	FileName string
 	Action   string
-	Errors   []error
+	// Instances contains the paths of the instances from which the file is
+	// derived, if any.
+	Instances []string
+	Errors    []error
 }
 
 func (err ErrFile) Error() string {
@@ -102,9 +189,9 @@ func (err ErrFile) Error() string {
 		action = "reading"
 	}
 	if len(err.Errors) == 1 {
-		return fmt.Sprintf("error when %s file %q: %s", err.Action, err.FileName, err.Errors[0])
+		return fmt.Sprintf("error when %s file %q: %s", action, err.FileName, err.Errors[0])
 	}
-	return fmt.Sprintf("%d errors when %s file %q", len(err.Errors), err.Action, err.FileName)
+	return fmt.Sprintf("%d errors when %s file %q", len(err.Errors), action, err.FileName)
 }
 
 // ErrsFile is an error containing a number of *ErrFile items.
@@ -116,3 +203,13 @@ func (err ErrsFile) Error() string {
 	}
 	return fmt.Sprintf("one or more errors on %d files", len(err))
 }
+
+// appendErrFile appends err to errs. If err is an ErrsFile, then each of its
+// items is appended. Otherwise, err is appended as an error when syncing the
+// file name.
+func appendErrFile(errs ErrsFile, name string, err error) ErrsFile {
+	if e, ok := err.(ErrsFile); ok {
+		return append(errs, e...)
+	}
+	return append(errs, &ErrFile{FileName: name, Action: "syncing", Errors: []error{err}})
+}
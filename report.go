@@ -0,0 +1,201 @@
+package rbxfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// EventKind indicates the kind of an Event.
+type EventKind byte
+
+const (
+	// EventRulesLoaded indicates that the rules used for syncing have been
+	// loaded. Rules contains the loaded rules.
+	EventRulesLoaded EventKind = iota
+	// EventSyncStarted indicates that a place or directory has started to
+	// be synced. Name and Target are set.
+	EventSyncStarted
+	// EventActionPlanned indicates that an operation on a file has been
+	// planned. Item is set.
+	EventActionPlanned
+	// EventFileWritten indicates that a file or directory has been written.
+	// Item is set.
+	EventFileWritten
+	// EventSyncFinished indicates that a place or directory has finished
+	// being synced. Stats counts the files that were actually changed.
+	EventSyncFinished
+	// EventWarning indicates a problem that does not prevent syncing. Err is
+	// set.
+	EventWarning
+	// EventError indicates a problem that prevents a file from being synced.
+	// Err is set.
+	EventError
+	// EventRuleRejected indicates that a rule matched an item, but could not
+	// be applied to it, so that a rule of lower precedence is used instead.
+	// This is a normal part of syncing. Err is set.
+	EventRuleRejected
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventRulesLoaded:
+		return "rules-loaded"
+	case EventSyncStarted:
+		return "sync-started"
+	case EventActionPlanned:
+		return "action-planned"
+	case EventFileWritten:
+		return "file-written"
+	case EventSyncFinished:
+		return "sync-finished"
+	case EventWarning:
+		return "warning"
+	case EventError:
+		return "error"
+	case EventRuleRejected:
+		return "rule-rejected"
+	}
+	return ""
+}
+
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Event describes the progress of a sync operation.
+type Event struct {
+	Kind     EventKind
+	SyncType SyncType
+	// Name is the name of the place or directory being synced.
+	Name string
+	// Target is the directory or place file being written.
+	Target string
+	Rules  []RulePair
+	Item   *PlanItem
+	Stats  *PlanStats
+	Err    error
+}
+
+// Reporter receives events from sync operations. Report may be called from
+// multiple goroutines.
+type Reporter interface {
+	Report(e Event)
+}
+
+// ReporterFunc adapts a function to a Reporter.
+type ReporterFunc func(e Event)
+
+func (f ReporterFunc) Report(e Event) {
+	f(e)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Report(Event) {}
+
+func getReporter(opt *Options) Reporter {
+	if opt == nil || opt.Reporter == nil {
+		return nopReporter{}
+	}
+	return opt.Reporter
+}
+
+// ConsoleReporter writes events to a writer in a human-readable form.
+type ConsoleReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// Verbose causes loaded rules, unchanged files, and rejected rules to be
+	// written.
+	Verbose bool
+}
+
+// NewConsoleReporter returns a ConsoleReporter that writes to w.
+func NewConsoleReporter(w io.Writer, verbose bool) *ConsoleReporter {
+	return &ConsoleReporter{w: w, Verbose: verbose}
+}
+
+func (r *ConsoleReporter) Report(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch e.Kind {
+	case EventRulesLoaded:
+		if !r.Verbose {
+			return
+		}
+		fmt.Fprintf(r.w, "sync-%s rules: %d\n", e.SyncType, len(e.Rules))
+		for _, rule := range e.Rules {
+			fmt.Fprintf(r.w, "\t%s\n", rule)
+		}
+	case EventSyncStarted:
+		fmt.Fprintf(r.w, "sync-%s `%s` -> `%s`\n", e.SyncType, e.Name, e.Target)
+	case EventActionPlanned:
+		if e.Item.Op == PlanNone && !r.Verbose {
+			return
+		}
+		kind := "file"
+		if e.Item.IsDir {
+			kind = "dir "
+		}
+		fmt.Fprintf(r.w, "\t%-6s %s %s\n", e.Item.Op, kind, e.Item.Path)
+	case EventFileWritten:
+		if !r.Verbose {
+			return
+		}
+		fmt.Fprintf(r.w, "\twrote %s\n", e.Item.Path)
+	case EventSyncFinished:
+		fmt.Fprintf(r.w, "\t%s\n", e.Stats)
+	case EventWarning:
+		fmt.Fprintf(r.w, "WARNING: %s\n", e.Err)
+	case EventError:
+		fmt.Fprintf(r.w, "ERROR: %s\n", e.Err)
+	case EventRuleRejected:
+		if !r.Verbose {
+			return
+		}
+		fmt.Fprintf(r.w, "\trejected: %s\n", e.Err)
+	}
+}
+
+// JSONReporter writes each event to a writer as a single line of JSON.
+type JSONReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONReporter returns a JSONReporter that writes to w.
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{enc: json.NewEncoder(w)}
+}
+
+type jsonEvent struct {
+	Event    EventKind  `json:"event"`
+	SyncType string     `json:"sync_type,omitempty"`
+	Name     string     `json:"name,omitempty"`
+	Target   string     `json:"target,omitempty"`
+	Rules    []string   `json:"rules,omitempty"`
+	Item     *PlanItem  `json:"item,omitempty"`
+	Stats    *PlanStats `json:"stats,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+func (r *JSONReporter) Report(e Event) {
+	je := jsonEvent{
+		Event:    e.Kind,
+		SyncType: e.SyncType.String(),
+		Name:     e.Name,
+		Target:   e.Target,
+		Item:     e.Item,
+		Stats:    e.Stats,
+	}
+	for _, rule := range e.Rules {
+		je.Rules = append(je.Rules, rule.String())
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(&je)
+}
@@ -11,25 +11,40 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"unicode"
 )
 
+// Each pattern and filter has a list of argument types, which determines the
+// arguments received by the function. Defaults is an optional list of default
+// values, which apply to the trailing arguments. For example, if a function
+// has 3 arguments and 1 default value, then the third argument is optional.
+// Each default value is parsed according to the type of its argument.
+
 type OutPattern struct {
-	Args []ArgType
-	Func func(opt *Options, args []Arg, obj *rbxfile.Instance) (sobj []int, sprop []string, err error)
+	Args     []ArgType
+	Defaults []string
+	Func     func(opt *Options, args []Arg, obj *rbxfile.Instance) (sobj []int, sprop []string, err error)
 }
 type OutFilter struct {
-	Args []ArgType
-	Func func(opt *Options, args []Arg, obj *rbxfile.Instance, sobj []int, sprop []string) (om []OutMap, err error)
+	Args     []ArgType
+	Defaults []string
+	Func     func(opt *Options, args []Arg, obj *rbxfile.Instance, sobj []int, sprop []string) (om []OutMap, err error)
+	// MayReject indicates that Func may reject selections by setting
+	// OutMap.Reject, leaving the rejected items to earlier rules.
+	MayReject bool
 }
 type InPattern struct {
-	Args []ArgType
-	Func func(opt *Options, args []Arg, path string) (sfile []string, err error)
+	Args     []ArgType
+	Defaults []string
+	Func     func(opt *Options, args []Arg, path string) (sfile []string, err error)
 }
 type InFilter struct {
-	Args []ArgType
-	Func func(opt *Options, args []Arg, sm []SourceMap) (is []InSelection, err error)
+	Args     []ArgType
+	Defaults []string
+	Func     func(opt *Options, args []Arg, sm []SourceMap) (is []InSelection, err error)
 }
 
 // Defines a file.
@@ -40,14 +55,20 @@ type FileDef struct {
 
 type OutAction struct {
 	Depth int
-	Dir   []string
-	Map   OutMap
+	// Rule is the rule that produced the action.
+	Rule *RulePair
+	Dir  []string
+	Map  OutMap
 }
 
 // associates a selection with a file
 type OutMap struct {
 	File      FileDef
 	Selection []OutSelection
+	// Reject, if not empty, indicates that the filter rejected the selection,
+	// and describes why. A rejected map is not written, but is reported when
+	// explaining rules. Rejected maps are not returned by CallOut.
+	Reject string
 }
 
 // Selects items from a source object.
@@ -63,7 +84,9 @@ type OutSelection struct {
 }
 
 type InAction struct {
-	Depth     int
+	Depth int
+	// Rule is the rule that produced the action.
+	Rule      *RulePair
 	Dir       []string
 	Selection []InSelection
 }
@@ -90,8 +113,80 @@ type ItemSource struct {
 }
 
 // Maps a file name to an ItemSource. Name is relative to top directory of
-// place.
-type SourceCache map[string]SourceCacheItem
+// place. A SourceCache is safe for concurrent use. The zero value is an empty
+// cache.
+type SourceCache struct {
+	mu    sync.RWMutex
+	items map[string]SourceCacheItem
+	// Sources decoded in advance of being selected by a rule. Each is moved
+	// to items once it is selected.
+	decoded map[string]decodeResult
+}
+
+// Get returns the cached source of the given file name.
+func (c *SourceCache) Get(name string) (item SourceCacheItem, ok bool) {
+	c.mu.RLock()
+	item, ok = c.items[name]
+	c.mu.RUnlock()
+	return item, ok
+}
+
+// Set sets the cached source of the given file name.
+func (c *SourceCache) Set(name string, item SourceCacheItem) {
+	c.mu.Lock()
+	if c.items == nil {
+		c.items = map[string]SourceCacheItem{}
+	}
+	c.items[name] = item
+	c.mu.Unlock()
+}
+
+// setDecoded replaces the sources decoded in advance.
+func (c *SourceCache) setDecoded(decoded map[string]decodeResult) {
+	c.mu.Lock()
+	c.decoded = decoded
+	c.mu.Unlock()
+}
+
+// takeDecoded removes and returns the source of the given file name that was
+// decoded in advance.
+func (c *SourceCache) takeDecoded(name string) (r decodeResult, ok bool) {
+	c.mu.Lock()
+	r, ok = c.decoded[name]
+	delete(c.decoded, name)
+	c.mu.Unlock()
+	return r, ok
+}
+
+// Invalidate removes the cached source of the given file name, as well as
+// the sources of any files within it. Returns the removed items.
+func (c *SourceCache) Invalidate(name string) []SourceCacheItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var items []SourceCacheItem
+	prefix := name + string(filepath.Separator)
+	for key, item := range c.items {
+		if key == name || strings.HasPrefix(key, prefix) {
+			items = append(items, item)
+			delete(c.items, key)
+		}
+	}
+	for key := range c.decoded {
+		if key == name || strings.HasPrefix(key, prefix) {
+			delete(c.decoded, key)
+		}
+	}
+	return items
+}
+
+// each calls fn for each cached source.
+func (c *SourceCache) each(fn func(name string, item SourceCacheItem)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for name, item := range c.items {
+		fn(name, item)
+	}
+}
 
 type InSelection struct {
 	File       string         // select file name matching SourceMap.File
@@ -103,6 +198,12 @@ type InSelection struct {
 
 ////////////////////////////////////////////////////////////////
 
+// FuncDef defines the patterns and filters available to rules. To extend the
+// default definitions, DefaultRuleDefs can be cloned, and the clone passed to
+// Options.RuleDefs:
+//
+//	defs := rbxfs.DefaultRuleDefs.Clone().
+//	    RegisterOutFilter("Custom", rbxfs.OutFilter{...})
 type FuncDef struct {
 	OutPattern map[string]OutPattern
 	OutFilter  map[string]OutFilter
@@ -110,6 +211,105 @@ type FuncDef struct {
 	InFilter   map[string]InFilter
 }
 
+// NewFuncDef returns an empty FuncDef.
+func NewFuncDef() *FuncDef {
+	return &FuncDef{
+		OutPattern: map[string]OutPattern{},
+		OutFilter:  map[string]OutFilter{},
+		InPattern:  map[string]InPattern{},
+		InFilter:   map[string]InFilter{},
+	}
+}
+
+// Clone returns a copy of fd, which can be modified without affecting fd.
+func (fd *FuncDef) Clone() *FuncDef {
+	c := NewFuncDef()
+	for name, def := range fd.OutPattern {
+		c.OutPattern[name] = def
+	}
+	for name, def := range fd.OutFilter {
+		c.OutFilter[name] = def
+	}
+	for name, def := range fd.InPattern {
+		c.InPattern[name] = def
+	}
+	for name, def := range fd.InFilter {
+		c.InFilter[name] = def
+	}
+	return c
+}
+
+// checkFuncName panics if name cannot be used as the name of a function
+// within a rule, or if the default values of spec are invalid.
+func checkFuncName(name string, hasFunc bool, spec argSpec) {
+	if name == "" {
+		panic("rbxfs: empty function name")
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') {
+			panic(fmt.Sprintf("rbxfs: invalid function name %q", name))
+		}
+	}
+	if !hasFunc {
+		panic(fmt.Sprintf("rbxfs: function %q has nil Func", name))
+	}
+	if len(spec.Defaults) > len(spec.Args) {
+		panic(fmt.Sprintf("rbxfs: function %q has %d defaults for %d arguments", name, len(spec.Defaults), len(spec.Args)))
+	}
+	for i := spec.required(); i < len(spec.Args); i++ {
+		if _, err := spec.parseDefault(i); err != nil {
+			panic(fmt.Sprintf("rbxfs: function %q: invalid default for argument %d: %s", name, i+1, err))
+		}
+	}
+}
+
+// RegisterOutPattern adds an out pattern with the given name, replacing any
+// existing pattern of the same name. It returns fd, so that calls can be
+// chained. Panics if name is not a valid function name, if def has no Func,
+// or if def has more defaults than arguments, or a default that cannot be
+// parsed as its argument type.
+func (fd *FuncDef) RegisterOutPattern(name string, def OutPattern) *FuncDef {
+	checkFuncName(name, def.Func != nil, argSpec{Args: def.Args, Defaults: def.Defaults})
+	if fd.OutPattern == nil {
+		fd.OutPattern = map[string]OutPattern{}
+	}
+	fd.OutPattern[name] = def
+	return fd
+}
+
+// RegisterOutFilter adds an out filter with the given name, in the same
+// manner as RegisterOutPattern.
+func (fd *FuncDef) RegisterOutFilter(name string, def OutFilter) *FuncDef {
+	checkFuncName(name, def.Func != nil, argSpec{Args: def.Args, Defaults: def.Defaults})
+	if fd.OutFilter == nil {
+		fd.OutFilter = map[string]OutFilter{}
+	}
+	fd.OutFilter[name] = def
+	return fd
+}
+
+// RegisterInPattern adds an in pattern with the given name, in the same
+// manner as RegisterOutPattern.
+func (fd *FuncDef) RegisterInPattern(name string, def InPattern) *FuncDef {
+	checkFuncName(name, def.Func != nil, argSpec{Args: def.Args, Defaults: def.Defaults})
+	if fd.InPattern == nil {
+		fd.InPattern = map[string]InPattern{}
+	}
+	fd.InPattern[name] = def
+	return fd
+}
+
+// RegisterInFilter adds an in filter with the given name, in the same manner
+// as RegisterOutPattern.
+func (fd *FuncDef) RegisterInFilter(name string, def InFilter) *FuncDef {
+	checkFuncName(name, def.Func != nil, argSpec{Args: def.Args, Defaults: def.Defaults})
+	if fd.InFilter == nil {
+		fd.InFilter = map[string]InFilter{}
+	}
+	fd.InFilter[name] = def
+	return fd
+}
+
 type ErrSyncFunc struct {
 	SyncType SyncType
 	FuncType FuncType
@@ -139,7 +339,15 @@ func (err ErrSyncPair) Error() string {
 	return fmt.Sprintf("expected sync-%s function pair, got sync-%s", err.Expected, err.Got)
 }
 
-func (fd FuncDef) CallOut(opt *Options, pair rulePair, obj *rbxfile.Instance) (om []OutMap, err error) {
+// CallOut applies the out rule pair to obj, returning the maps produced by
+// its filter. Selections rejected by the filter are not included.
+func (fd FuncDef) CallOut(opt *Options, pair RulePair, obj *rbxfile.Instance) (om []OutMap, err error) {
+	om, _, err = fd.callOut(opt, pair, obj)
+	return om, err
+}
+
+// callOut is like CallOut, but also returns the maps rejected by the filter.
+func (fd FuncDef) callOut(opt *Options, pair RulePair, obj *rbxfile.Instance) (om, rejected []OutMap, err error) {
 	if pair.SyncType != SyncOut {
 		err = ErrSyncPair{Expected: SyncOut, Got: pair.SyncType}
 		return
@@ -165,14 +373,22 @@ func (fd FuncDef) CallOut(opt *Options, pair rulePair, obj *rbxfile.Instance) (o
 		return
 	}
 
-	om, err = filterFn.Func(opt, pair.Filter.Args, obj, sobj, sprop)
+	maps, err := filterFn.Func(opt, pair.Filter.Args, obj, sobj, sprop)
 	if err != nil {
 		err = ErrSyncFunc{SyncType: SyncOut, FuncType: Filter, Name: pair.Filter.Name, Err: err}
+		return
+	}
+	for _, m := range maps {
+		if m.Reject != "" {
+			rejected = append(rejected, m)
+		} else {
+			om = append(om, m)
+		}
 	}
 	return
 }
 
-func (fd FuncDef) CallIn(opt *Options, cache SourceCache, pair rulePair, dirname, subdir string, refs map[string]*rbxfile.Instance) (is []InSelection, err error) {
+func (fd FuncDef) CallIn(opt *Options, cache *SourceCache, pair RulePair, dirname, subdir string, refs map[string]*rbxfile.Instance) (is []InSelection, err error) {
 	if pair.SyncType != SyncIn {
 		err = ErrSyncPair{Expected: SyncIn, Got: pair.SyncType}
 		return
@@ -198,54 +414,51 @@ func (fd FuncDef) CallIn(opt *Options, cache SourceCache, pair rulePair, dirname
 		return
 	}
 
+	// Decode sources that are not cached, or decoded in advance by the cache.
+	// Decoding is done concurrently, with each file assigning references to
+	// its own map. The references are then merged into refs in order, so that
+	// refs is only modified here.
+	results := make([]decodeResult, len(sfile))
+	missing := make([]int, 0, len(sfile))
+	for i, name := range sfile {
+		relname := filepath.Join(subdir, name)
+		if item, ok := cache.Get(relname); ok {
+			results[i].item = item
+		} else if r, ok := cache.takeDecoded(relname); ok {
+			results[i] = r
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	forEach(getFileWorkers(opt), len(missing), func(j int) {
+		i := missing[j]
+		results[i] = decodeSource(opt, pair.Pattern.Name, filepath.Join(dirname, subdir), sfile[i])
+	})
+
 	errs := make(ErrsFile, 0, len(sfile))
 	sm := make([]SourceMap, 0, len(sfile))
-	for _, name := range sfile {
+	for i, name := range sfile {
 		relname := filepath.Join(subdir, name)
-		scItem, ok := cache[relname]
-		if !ok {
-			r, err := os.Open(filepath.Join(opt.Repo, dirname, relname))
-			if err != nil {
-				errs = append(errs, &ErrFile{FileName: relname, Errors: []error{err}})
-				continue
-			}
-			defer r.Close()
-			stat, err := r.Stat()
-			if err != nil {
-				errs = append(errs, &ErrFile{FileName: relname, Errors: []error{err}})
-				continue
+		r := results[i]
+		if r.err != nil {
+			errs = append(errs, &ErrFile{FileName: relname, Errors: []error{r.err}})
+			continue
+		}
+		if r.skip {
+			continue
+		}
+		if r.refs != nil {
+			keys := make([]string, 0, len(r.refs))
+			for key := range r.refs {
+				keys = append(keys, key)
 			}
-
-			scItem.IsDir = stat.IsDir()
-			if scItem.IsDir {
-				obj := &rbxfile.Instance{Properties: make(map[string]rbxfile.Value, 0)}
-				if err := readAuxData(filepath.Join(opt.Repo, dirname, relname), obj); err != nil {
-					// Ignore directory.
-					continue
-				}
-				rbxfile.GetReference(obj, refs)
-				obj.SetName(name)
-				scItem.Source = &ItemSource{Children: []*rbxfile.Instance{obj}}
-			} else {
-				format := GetFormatFromExt(filepath.Ext(name))
-				if format == nil {
-					err := ErrSyncFunc{SyncType: SyncIn, FuncType: Pattern, Name: pair.Pattern.Name, Err: ErrUnsupportedFormat{Format: filepath.Ext(name)}}
-					errs = append(errs, &ErrFile{FileName: relname, Errors: []error{err}})
-					continue
-				}
-				format.SetAPI(opt.API)
-				format.SetReferences(refs)
-				var err error
-				scItem.Source, err = format.Decode(r)
-				if err != nil {
-					errs = append(errs, &ErrFile{FileName: relname, Errors: []error{err}})
-					continue
-				}
+			sort.Strings(keys)
+			for _, key := range keys {
+				rbxfile.GetReference(r.refs[key], refs)
 			}
-
-			cache[relname] = scItem
+			cache.Set(relname, r.item)
 		}
-		sm = append(sm, SourceMap{File: name, SourceCacheItem: scItem})
+		sm = append(sm, SourceMap{File: name, SourceCacheItem: r.item})
 	}
 
 	if len(errs) > 0 {
@@ -259,6 +472,55 @@ func (fd FuncDef) CallIn(opt *Options, cache SourceCache, pair rulePair, dirname
 	return is, err
 }
 
+// decodeResult is the result of decoding a single source file.
+type decodeResult struct {
+	item SourceCacheItem
+	refs map[string]*rbxfile.Instance
+	skip bool
+	err  error
+}
+
+// decodeSource decodes the file of the given name within dir, which is
+// relative to the repository. References are assigned to a map of the
+// result. pattern is the name of the pattern that selected the file.
+func decodeSource(opt *Options, pattern, dir, name string) (r decodeResult) {
+	r.refs = map[string]*rbxfile.Instance{}
+	path := filepath.Join(opt.Repo, dir, name)
+	stat, err := os.Stat(path)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.item.IsDir = stat.IsDir()
+	if r.item.IsDir {
+		obj := &rbxfile.Instance{Properties: make(map[string]rbxfile.Value, 0)}
+		if err := readAuxData(path, obj); err != nil {
+			// Ignore directory.
+			r.skip = true
+			return r
+		}
+		rbxfile.GetReference(obj, r.refs)
+		obj.SetName(name)
+		r.item.Source = &ItemSource{Children: []*rbxfile.Instance{obj}}
+		return r
+	}
+	format := getFormats(opt).FromFileName(name)
+	if format == nil {
+		r.err = ErrSyncFunc{SyncType: SyncIn, FuncType: Pattern, Name: pattern, Err: ErrUnsupportedFormat{Format: filepath.Ext(name)}}
+		return r
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer f.Close()
+	format.SetAPI(opt.API)
+	format.SetReferences(r.refs)
+	r.item.Source, r.err = format.Decode(f)
+	return r
+}
+
 type auxData struct {
 	ClassName string `json:"class_name"`
 	Reference string `json:"reference"`
@@ -267,23 +529,15 @@ type auxData struct {
 
 const auxDataFileName = "data"
 
-func writeAuxData(path string, obj *rbxfile.Instance) error {
+// encodeAuxData returns the content of the auxiliary data file of a
+// directory created from obj.
+func encodeAuxData(obj *rbxfile.Instance) ([]byte, error) {
 	data := auxData{
 		ClassName: obj.ClassName,
 		Reference: obj.Reference,
 		IsService: obj.IsService,
 	}
-	b, err := json.MarshalIndent(&data, "", "\t")
-	if err != nil {
-		return err
-	}
-	f, err := os.Create(filepath.Join(path, auxDataFileName))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = f.Write(b)
-	return err
+	return json.MarshalIndent(&data, "", "\t")
 }
 
 func readAuxData(path string, obj *rbxfile.Instance) error {
@@ -304,7 +558,10 @@ func readAuxData(path string, obj *rbxfile.Instance) error {
 	return nil
 }
 
-func inherits(api *rbxapi.API, obj *rbxfile.Instance, className string) bool {
+// Inherits returns whether the class of obj is className, or inherits from
+// className according to api. If api is nil, then only the class of obj is
+// compared.
+func Inherits(api *rbxapi.API, obj *rbxfile.Instance, className string) bool {
 	if api == nil {
 		return obj.ClassName == className
 	}
@@ -317,7 +574,9 @@ func inherits(api *rbxapi.API, obj *rbxfile.Instance, className string) bool {
 	return false
 }
 
-func isValidFileName(name string, isDir bool) bool {
+// IsValidFileName returns whether name is suitable as the name of a file or
+// directory created by a filter.
+func IsValidFileName(name string, isDir bool) bool {
 	if len(name) == 0 || len(name) > 255 ||
 		name == "." || name == ".." {
 		return false
@@ -356,7 +615,7 @@ var DefaultRuleDefs = &FuncDef{
 					api = nil
 				}
 				for i, child := range obj.Children {
-					if inherits(api, child, class.Name.Literal) {
+					if Inherits(api, child, class.Name.Literal) {
 						sobj = append(sobj, i)
 					}
 				}
@@ -365,7 +624,8 @@ var DefaultRuleDefs = &FuncDef{
 			},
 		},
 		"Property": {
-			Args: []ArgType{ArgTypeClass, ArgTypeName, ArgTypeName},
+			Args:     []ArgType{ArgTypeClass, ArgTypeName, ArgTypeName},
+			Defaults: []string{"*"},
 			Func: func(opt *Options, args []Arg, obj *rbxfile.Instance) (sobj []int, sprop []string, err error) {
 				class := args[0].(ArgClass)
 				prop := args[1].(ArgName)
@@ -376,7 +636,7 @@ var DefaultRuleDefs = &FuncDef{
 					if class.NoSub {
 						api = nil
 					}
-					if !inherits(api, obj, class.Name.Literal) {
+					if !Inherits(api, obj, class.Name.Literal) {
 						return
 					}
 				}
@@ -398,7 +658,7 @@ var DefaultRuleDefs = &FuncDef{
 			Func: func(opt *Options, args []Arg, obj *rbxfile.Instance, sobj []int, sprop []string) (om []OutMap, err error) {
 				name := string(args[0].(ArgString))
 
-				format := GetFormatFromExt(filepath.Ext(name))
+				format := getFormats(opt).FromFileName(name)
 				if format == nil {
 					return nil, ErrUnsupportedFormat{Format: filepath.Ext(name)}
 				}
@@ -413,7 +673,8 @@ var DefaultRuleDefs = &FuncDef{
 			},
 		},
 		"Directory": {
-			Args: []ArgType{},
+			Args:      []ArgType{},
+			MayReject: true,
 			Func: func(opt *Options, args []Arg, obj *rbxfile.Instance, sobj []int, sprop []string) (om []OutMap, err error) {
 				if len(sprop) > 0 {
 					return nil, errors.New("property selections incompatible with filter")
@@ -422,7 +683,13 @@ var DefaultRuleDefs = &FuncDef{
 			loop:
 				for _, n := range sobj {
 					child := obj.Children[n]
-					if !isValidFileName(child.Name(), true) {
+					m := OutMap{
+						File:      FileDef{Name: child.Name(), IsDir: true},
+						Selection: []OutSelection{{Object: obj, Children: []int{n}}},
+					}
+					if !IsValidFileName(child.Name(), true) {
+						m.Reject = fmt.Sprintf("invalid directory name %q", child.Name())
+						om = append(om, m)
 						continue loop
 					}
 					for i, c := range obj.Children {
@@ -432,60 +699,48 @@ var DefaultRuleDefs = &FuncDef{
 						if c.Name() == child.Name() {
 							// Fail if child shares its name with any other
 							// sibling.
+							m.Reject = fmt.Sprintf("name %q shared with sibling #%d", child.Name(), i)
+							om = append(om, m)
 							continue loop
 						}
 					}
-					om = append(om, OutMap{
-						File:      FileDef{Name: child.Name(), IsDir: true},
-						Selection: []OutSelection{{Object: obj, Children: []int{n}}},
-					})
+					om = append(om, m)
 				}
 
 				return
 			},
 		},
 		"PropertyName": {
-			Args: []ArgType{ArgTypeString},
+			Args:      []ArgType{ArgTypeString},
+			MayReject: true,
 			Func: func(opt *Options, args []Arg, obj *rbxfile.Instance, sobj []int, sprop []string) (om []OutMap, err error) {
 				if len(sobj) > 0 {
 					return nil, errors.New("object selections incompatible with filter")
 				}
 
-				ext := strings.ToLower(string(args[0].(ArgString)))
-
-				var format Format
-				var typ rbxfile.Type
-				switch ext {
-				case "bin":
-					format = &FormatBin{}
-					typ = rbxfile.TypeBinaryString
-				case "lua":
-					format = &FormatLua{}
-					typ = rbxfile.TypeProtectedString
-				case "txt":
-					format = &FormatText{}
-					typ = rbxfile.TypeString
-				default:
+				ext := normalizeExt(string(args[0].(ArgString)))
+				format := getFormats(opt).Lookup(ext)
+				if format == nil {
 					return nil, ErrUnsupportedFormat{Format: ext}
 				}
 
 				for _, name := range sprop {
 					file := name + "." + ext
-					if !isValidFileName(file, false) {
+					m := OutMap{
+						File:      FileDef{Name: file, IsDir: false},
+						Selection: []OutSelection{{Object: obj, Properties: []string{name}}},
+					}
+					if !IsValidFileName(file, false) {
+						m.Reject = fmt.Sprintf("invalid file name %q", file)
+						om = append(om, m)
 						continue
 					}
-					_ = typ
-					// if obj.Properties[name].Type() != typ {
-					// 	continue
-					// }
-					sel := []OutSelection{{Object: obj, Properties: []string{name}}}
-					if !format.CanEncode(sel) {
+					if !format.CanEncode(m.Selection) {
+						m.Reject = fmt.Sprintf("property cannot be encoded as %s", format.Name())
+						om = append(om, m)
 						continue
 					}
-					om = append(om, OutMap{
-						File:      FileDef{Name: file, IsDir: false},
-						Selection: sel,
-					})
+					om = append(om, m)
 				}
 
 				return
@@ -520,7 +775,7 @@ var DefaultRuleDefs = &FuncDef{
 					return
 				}
 				for _, file := range files {
-					if file.IsDir() {
+					if file.IsDir() || file.Name() == DirRulesFileName {
 						continue
 					}
 					if name.Match(file.Name()) {
@@ -560,7 +815,7 @@ var DefaultRuleDefs = &FuncDef{
 						if class.NoSub {
 							api = nil
 						}
-						if !inherits(api, aux, class.Name.Literal) {
+						if !Inherits(api, aux, class.Name.Literal) {
 							continue
 						}
 					}
@@ -653,11 +908,18 @@ var DefaultRuleDefs = &FuncDef{
 						return nil, errors.New("source must contain only one value")
 					}
 				}
+				formats := getFormats(opt)
 				is = make([]InSelection, len(sm))
 				for i, m := range sm {
+					// The property is named by the file, excluding the
+					// extension of the format.
+					name := filepath.Base(m.File)
+					if ext := formats.FileExt(name); ext != "" {
+						name = name[:len(name)-len(ext)-1]
+					}
 					is[i] = InSelection{
 						File:   m.File,
-						Values: map[string]int{filepath.Base(m.File): 0},
+						Values: map[string]int{name: 0},
 					}
 				}
 				return
@@ -715,20 +977,24 @@ const (
 	Filter
 )
 
-type ruleFunc struct {
+// RuleFunc is a parsed call to a pattern or filter.
+type RuleFunc struct {
 	FuncType FuncType
 	Name     string
 	Args     []Arg
 }
 
-type rulePair struct {
+// RulePair is a single parsed rule, pairing a pattern with a filter. Depth
+// indicates the source of the rule; rules with a greater depth take
+// precedence.
+type RulePair struct {
 	Depth    int
 	SyncType SyncType
-	Pattern  ruleFunc
-	Filter   ruleFunc
+	Pattern  RuleFunc
+	Filter   RuleFunc
 }
 
-func (r rulePair) String() string {
+func (r RulePair) String() string {
 	args := func(args []Arg) string {
 		var s []string
 		for _, arg := range args {
@@ -749,12 +1015,40 @@ func (r rulePair) String() string {
 // ErrParseRule is an error occurring when parsing a particular line of a rule
 // file.
 type ErrParseRule struct {
+	// File is the name of the rule file in which the error occurred. This
+	// may be a file included by the rule file being parsed.
+	File string
 	Line int
-	Err  error
+	// Column and EndColumn indicate the span of bytes within the line that
+	// caused the error, starting at 1. Both are 0 if the span is unknown.
+	Column, EndColumn int
+	Err               error
 }
 
 func (err ErrParseRule) Error() string {
-	return fmt.Sprintf("line %d: %s", err.Line, err.Err.Error())
+	pos := fmt.Sprintf("line %d", err.Line)
+	if err.File != "" {
+		pos = fmt.Sprintf("%s:%d", err.File, err.Line)
+	}
+	if err.Column > 0 {
+		pos = fmt.Sprintf("%s:%d", pos, err.Column)
+	}
+	return fmt.Sprintf("%s: %s", pos, err.Err.Error())
+}
+
+// errUnknownFunc is an error indicating that a rule calls an undefined pattern
+// or filter. Suggestion is the name of a defined function that is similar to
+// Name, if any.
+type errUnknownFunc struct {
+	Name       string
+	Suggestion string
+}
+
+func (err errUnknownFunc) Error() string {
+	if err.Suggestion != "" {
+		return fmt.Sprintf("unknown function %q (did you mean %q?)", err.Name, err.Suggestion)
+	}
+	return fmt.Sprintf("unknown function %q", err.Name)
 }
 
 // ErrsParseRule is an error containing a number of *ErrParseRule items.
@@ -765,13 +1059,47 @@ func (err ErrsParseRule) Error() string {
 }
 
 type ruleParser struct {
-	defs  *FuncDef
-	r     io.Reader
-	depth int
-	err   error // error per line
-	line  int
-	funcs []rulePair
-	errs  ErrsParseRule // errors over all lines
+	defs   *FuncDef
+	r      io.Reader
+	file   string   // name of file being parsed
+	stack  []string // absolute paths of files being parsed, for detecting cycles
+	preset bool     // whether rules are from a preset
+	depth  int
+	text   string // content of current line
+	err    error  // error per line
+	errCol int    // offset of error within line
+	errEnd int    // offset of end of error within line
+	line   int
+	funcs  []RulePair
+	pos    []rulePos     // position of each rule in funcs
+	errs   ErrsParseRule // errors over all lines
+}
+
+// rulePos indicates where a rule was defined. Offsets are in bytes from the
+// start of the line.
+type rulePos struct {
+	File                     string
+	Line                     int
+	Preset                   bool
+	Start, End               int
+	PatternStart, PatternEnd int
+	FilterStart, FilterEnd   int
+}
+
+// offset returns the offset of the remaining portion of the current line.
+func (d *ruleParser) offset(rem string) int {
+	return len(d.text) - len(rem)
+}
+
+// fail sets the error of the current line, spanning n bytes from the start
+// of rem, which is the remaining portion of the current line.
+func (d *ruleParser) fail(rem string, n int, err error) {
+	if n < 1 {
+		n = 1
+	}
+	d.err = err
+	d.errCol = d.offset(rem)
+	d.errEnd = d.errCol + n
 }
 
 func (*ruleParser) ident(s string) string {
@@ -781,23 +1109,30 @@ func (*ruleParser) ident(s string) string {
 		}
 		return s[:i]
 	}
-	return ""
+	return s
 }
 
-func (d *ruleParser) parseRules() (rp []rulePair, err error) {
+func (d *ruleParser) parseRules() (rp []RulePair, err error) {
 	s := bufio.NewScanner(d.r)
 	s.Split(bufio.ScanLines)
 	d.line = 1
 	for s.Scan() {
-		d.readLine(s.Text())
+		d.text = s.Text()
+		d.readLine(d.text)
 		if d.err != nil {
-			d.errs = append(d.errs, &ErrParseRule{Line: d.line, Err: d.err})
+			e := &ErrParseRule{File: d.file, Line: d.line, Err: d.err}
+			if d.errEnd > 0 {
+				e.Column = d.errCol + 1
+				e.EndColumn = d.errEnd + 1
+			}
+			d.errs = append(d.errs, e)
 			d.err = nil
+			d.errCol, d.errEnd = 0, 0
 		}
 		d.line++
 	}
 	if s.Err() != nil {
-		d.errs = append(d.errs, &ErrParseRule{Line: d.line, Err: s.Err()})
+		d.errs = append(d.errs, &ErrParseRule{File: d.file, Line: d.line, Err: s.Err()})
 	}
 	if len(d.errs) > 0 {
 		err = d.errs
@@ -808,6 +1143,8 @@ func (d *ruleParser) parseRules() (rp []rulePair, err error) {
 
 func (d *ruleParser) readLine(line string) {
 	const ruleOpComment = "#"
+	const ruleOpInclude = "include"
+	const ruleOpPreset = "preset"
 
 	line = strings.TrimLeftFunc(line, unicode.IsSpace)
 	if len(line) == 0 {
@@ -818,107 +1155,253 @@ func (d *ruleParser) readLine(line string) {
 		// comment
 		return
 	}
+	if d.ident(line) == ruleOpInclude {
+		d.readInclude(line[len(ruleOpInclude):])
+		return
+	}
+	if d.ident(line) == ruleOpPreset {
+		d.readPreset(line[len(ruleOpPreset):])
+		return
+	}
 	d.readRule(line)
 }
 
+// readInclude parses the rule file at the given path, adding its rules and
+// errors to the current parser. A relative path is resolved relative to the
+// directory of the current file.
+func (d *ruleParser) readInclude(path string) {
+	path = strings.TrimLeftFunc(path, unicode.IsSpace)
+	rem := path
+	path = strings.TrimRightFunc(path, unicode.IsSpace)
+	if path == "" {
+		d.fail(rem, 1, errors.New("include: expected file name"))
+		return
+	}
+	span := len(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(d.file), path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		d.fail(rem, span, fmt.Errorf("include %q: %s", path, err.Error()))
+		return
+	}
+	for _, file := range d.stack {
+		if file == abs {
+			d.fail(rem, span, fmt.Errorf("include %q: file includes itself", path))
+			return
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		d.fail(rem, span, fmt.Errorf("include: %s", err.Error()))
+		return
+	}
+	defer f.Close()
+
+	stack := make([]string, len(d.stack)+1)
+	copy(stack, d.stack)
+	stack[len(stack)-1] = abs
+	p := &ruleParser{
+		defs:  d.defs,
+		r:     f,
+		file:  path,
+		stack: stack,
+		depth: d.depth,
+	}
+	rp, _ := p.parseRules()
+	d.funcs = append(d.funcs, rp...)
+	d.pos = append(d.pos, p.pos...)
+	d.errs = append(d.errs, p.errs...)
+}
+
+// readPreset parses the rules of the built-in preset with the given name,
+// adding its rules and errors to the current parser.
+func (d *ruleParser) readPreset(name string) {
+	name = strings.TrimLeftFunc(name, unicode.IsSpace)
+	rem := name
+	name = strings.TrimRightFunc(name, unicode.IsSpace)
+	if name == "" {
+		d.fail(rem, 1, errors.New("preset: expected preset name"))
+		return
+	}
+	span := len(name)
+	rules, ok := Preset(name)
+	if !ok {
+		d.fail(rem, span, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(Presets(), ", ")))
+		return
+	}
+	file := presetFile(name)
+	for _, f := range d.stack {
+		if f == file {
+			d.fail(rem, span, fmt.Errorf("preset %q: preset includes itself", name))
+			return
+		}
+	}
+
+	stack := make([]string, len(d.stack)+1)
+	copy(stack, d.stack)
+	stack[len(stack)-1] = file
+	p := &ruleParser{
+		defs:   d.defs,
+		r:      strings.NewReader(rules),
+		file:   file,
+		stack:  stack,
+		preset: true,
+		depth:  d.depth,
+	}
+	rp, _ := p.parseRules()
+	d.funcs = append(d.funcs, rp...)
+	d.pos = append(d.pos, p.pos...)
+	d.errs = append(d.errs, p.errs...)
+}
+
 func (d *ruleParser) readRule(rule string) {
 	const ruleOpSep = ":"
 
 	var syncType SyncType
-	var patterns map[string][]ArgType
-	var filters map[string][]ArgType
+	var patterns map[string]argSpec
+	var filters map[string]argSpec
 
+	pos := rulePos{File: d.file, Line: d.line, Preset: d.preset, Start: d.offset(rule)}
 	typ := d.ident(rule)
 	switch typ {
 	case "out":
 		syncType = SyncOut
-		patterns = make(map[string][]ArgType, len(d.defs.OutPattern))
+		patterns = make(map[string]argSpec, len(d.defs.OutPattern))
 		for name, def := range d.defs.OutPattern {
-			patterns[name] = def.Args
+			patterns[name] = argSpec{Args: def.Args, Defaults: def.Defaults}
 		}
-		filters = make(map[string][]ArgType, len(d.defs.OutFilter))
+		filters = make(map[string]argSpec, len(d.defs.OutFilter))
 		for name, def := range d.defs.OutFilter {
-			filters[name] = def.Args
+			filters[name] = argSpec{Args: def.Args, Defaults: def.Defaults}
 		}
 	case "in":
 		syncType = SyncIn
-		patterns = make(map[string][]ArgType, len(d.defs.InPattern))
+		patterns = make(map[string]argSpec, len(d.defs.InPattern))
 		for name, def := range d.defs.InPattern {
-			patterns[name] = def.Args
+			patterns[name] = argSpec{Args: def.Args, Defaults: def.Defaults}
 		}
-		filters = make(map[string][]ArgType, len(d.defs.InFilter))
+		filters = make(map[string]argSpec, len(d.defs.InFilter))
 		for name, def := range d.defs.InFilter {
-			filters[name] = def.Args
+			filters[name] = argSpec{Args: def.Args, Defaults: def.Defaults}
 		}
 	default:
-		d.err = fmt.Errorf("unknown rule type %q", typ)
+		d.fail(rule, indexFunc(rule, unicode.IsSpace, true), fmt.Errorf("unknown rule type %q", typ))
 		return
 	}
 	rule = rule[len(typ):]
 
 	rule = strings.TrimLeftFunc(rule, unicode.IsSpace)
+	pos.PatternStart = d.offset(rule)
 	rule, rfp := d.readFunc(rule, patterns)
 	if d.err != nil {
 		return
 	}
 	rfp.FuncType = Pattern
+	pos.PatternEnd = d.offset(rule)
 
 	rule = strings.TrimLeftFunc(rule, unicode.IsSpace)
 	if strings.HasPrefix(rule, ruleOpSep) {
 		rule = rule[len(ruleOpSep):]
 	} else {
-		d.err = fmt.Errorf("bad syntax: expected %q", ruleOpSep)
+		d.fail(rule, 1, fmt.Errorf("bad syntax: expected %q", ruleOpSep))
 		return
 	}
 
 	rule = strings.TrimLeftFunc(rule, unicode.IsSpace)
+	pos.FilterStart = d.offset(rule)
 	rule, rff := d.readFunc(rule, filters)
 	if d.err != nil {
 		return
 	}
 	rff.FuncType = Filter
+	pos.FilterEnd = d.offset(rule)
+	pos.End = pos.FilterEnd
 
-	d.funcs = append(d.funcs, rulePair{
+	d.funcs = append(d.funcs, RulePair{
 		Depth:    d.depth,
 		SyncType: syncType,
 		Pattern:  rfp,
 		Filter:   rff,
 	})
+	d.pos = append(d.pos, pos)
 
 	rule = strings.TrimLeftFunc(rule, unicode.IsSpace)
 	if len(rule) != 0 {
-		d.err = errors.New("unexpected characters beyond filter")
+		d.fail(rule, len(strings.TrimRightFunc(rule, unicode.IsSpace)), errors.New("unexpected characters beyond filter"))
 		return
 	}
 }
 
-func (d *ruleParser) readFunc(rule string, args map[string][]ArgType) (left string, rf ruleFunc) {
+// argSpec describes the arguments of a pattern or filter.
+type argSpec struct {
+	Args     []ArgType
+	Defaults []string
+}
+
+// required returns the number of arguments that do not have a default value.
+func (a argSpec) required() int {
+	if len(a.Defaults) > len(a.Args) {
+		return 0
+	}
+	return len(a.Args) - len(a.Defaults)
+}
+
+// parseDefault parses the default value of the ith argument.
+func (a argSpec) parseDefault(i int) (Arg, error) {
+	arg, _, err := a.Args[i](a.Defaults[i-a.required()])
+	return arg, err
+}
+
+func (d *ruleParser) readFunc(rule string, args map[string]argSpec) (left string, rf RuleFunc) {
 	const ruleOpArgOpen = "("
 	const ruleOpArgClose = ")"
 	const ruleOpArgSep = ","
 
+	start := rule
 	rf.Name = d.ident(rule)
 	if len(rf.Name) == 0 {
-		d.err = errors.New("empty function name")
+		d.fail(rule, 1, errors.New("empty function name"))
 		return
 	}
-	argts, ok := args[rf.Name]
+	spec, ok := args[rf.Name]
 	if !ok {
-		d.err = fmt.Errorf("unknown function %q", rf.Name)
+		names := make([]string, 0, len(args))
+		for name := range args {
+			names = append(names, name)
+		}
+		d.fail(rule, len(rf.Name), errUnknownFunc{Name: rf.Name, Suggestion: nearestName(rf.Name, names)})
 		return
 	}
+	argts := spec.Args
+	required := spec.required()
 
 	rule = rule[len(rf.Name):]
 	if !strings.HasPrefix(rule, ruleOpArgOpen) {
-		d.err = fmt.Errorf("function %s: bad syntax: expected %q", rf.Name, ruleOpArgOpen)
+		d.fail(rule, 1, fmt.Errorf("function %s: bad syntax: expected %q", rf.Name, ruleOpArgOpen))
 		return
 	}
 	rule = rule[len(ruleOpArgOpen):]
 
-	for i, argt := range argts {
-		arg, n, err := argt(rule)
+	for i := 0; i < len(argts); i++ {
+		if i >= required && strings.HasPrefix(rule, ruleOpArgClose) {
+			// Fill in remaining arguments with default values.
+			for ; i < len(argts); i++ {
+				arg, err := spec.parseDefault(i)
+				if err != nil {
+					d.fail(start, len(rf.Name), fmt.Errorf("function %s: error parsing default value of argument #%d: %s", rf.Name, i, err.Error()))
+					return
+				}
+				rf.Args = append(rf.Args, arg)
+			}
+			break
+		}
+
+		arg, n, err := argts[i](rule)
 		if err != nil {
-			d.err = fmt.Errorf("function %s: error parsing argument #%d: %s", rf.Name, i, err.Error())
+			d.fail(rule, n, fmt.Errorf("function %s: error parsing argument #%d: %s", rf.Name, i, err.Error()))
 			return
 		}
 		rule = rule[n:]
@@ -926,11 +1409,19 @@ func (d *ruleParser) readFunc(rule string, args map[string][]ArgType) (left stri
 
 		if i < len(argts)-1 {
 			if strings.HasPrefix(rule, ruleOpArgClose) {
-				d.err = fmt.Errorf("function %s: expected %d arguments, got %d", rf.Name, len(argts), i+1)
+				if i+1 >= required {
+					continue
+				}
+				n := d.offset(rule) - d.offset(start) + len(ruleOpArgClose)
+				if required == len(argts) {
+					d.fail(start, n, fmt.Errorf("function %s: expected %d arguments, got %d", rf.Name, len(argts), i+1))
+				} else {
+					d.fail(start, n, fmt.Errorf("function %s: expected %d to %d arguments, got %d", rf.Name, required, len(argts), i+1))
+				}
 				return
 			}
 			if !strings.HasPrefix(rule, ruleOpArgSep) {
-				d.err = fmt.Errorf("function %s: bad syntax: expected %q", rf.Name, ruleOpArgSep)
+				d.fail(rule, 1, fmt.Errorf("function %s: bad syntax: expected %q", rf.Name, ruleOpArgSep))
 				return
 			}
 			rule = rule[len(ruleOpArgSep):]
@@ -938,13 +1429,21 @@ func (d *ruleParser) readFunc(rule string, args map[string][]ArgType) (left stri
 	}
 
 	if !strings.HasPrefix(rule, ruleOpArgClose) {
-		d.err = fmt.Errorf("function %s: bad syntax: expected %q", rf.Name, ruleOpArgClose)
+		if len(argts) > 0 && strings.HasPrefix(rule, ruleOpArgSep) {
+			n := strings.Index(rule, ruleOpArgClose)
+			if n < 0 {
+				n = len(rule)
+			}
+			d.fail(rule, n, fmt.Errorf("function %s: expected %d arguments, got more", rf.Name, len(argts)))
+			return
+		}
+		d.fail(rule, 1, fmt.Errorf("function %s: bad syntax: expected %q", rf.Name, ruleOpArgClose))
 		return
 	}
 	return rule[len(ruleOpArgClose):], rf
 }
 
-func parseRuleFile(opt *Options, depth int, path string) ([]rulePair, error) {
+func parseRuleFile(opt *Options, depth int, path string) ([]RulePair, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -954,15 +1453,19 @@ func parseRuleFile(opt *Options, depth int, path string) ([]rulePair, error) {
 	p := &ruleParser{
 		defs:  opt.RuleDefs,
 		r:     f,
+		file:  path,
 		depth: depth,
 	}
+	if abs, err := filepath.Abs(path); err == nil {
+		p.stack = []string{abs}
+	}
 	if p.defs == nil {
 		p.defs = DefaultRuleDefs
 	}
 	return p.parseRules()
 }
 
-func filterRuleType(rules []rulePair, typ SyncType) (out []rulePair) {
+func filterRuleType(rules []RulePair, typ SyncType) (out []RulePair) {
 	for _, rule := range rules {
 		if rule.SyncType == typ {
 			out = append(out, rule)
@@ -971,36 +1474,83 @@ func filterRuleType(rules []rulePair, typ SyncType) (out []rulePair) {
 	return
 }
 
-func getStdRules(opt *Options) (rules []rulePair, err error) {
+// Depths of rules from each source of rules. Rules from directory rule files
+// begin at ruleDepthDir, and increase by one for each subdirectory.
+const (
+	ruleDepthGlobal = iota + 1
+	ruleDepthProject
+	ruleDepthDir
+)
+
+// newErrRuleFile wraps an error returned by parseRuleFile into an *ErrFile.
+func newErrRuleFile(path string, err error) *ErrFile {
+	ef := &ErrFile{FileName: path}
+	switch err := err.(type) {
+	case ErrsParseRule:
+		ef.Errors = make([]error, len(err))
+		for i, e := range err {
+			ef.Errors[i] = e
+		}
+	default:
+		ef.Errors = []error{err}
+	}
+	return ef
+}
+
+// getStdRules returns the global rules followed by the project rules. A rule
+// file that does not exist is treated as having no rules.
+func getStdRules(opt *Options) (rules []RulePair, err error) {
 	errs := make(ErrsFile, 0, 2)
-	for i, path := range []string{globalRulePath(), projectRulePath(opt.Repo)} {
-		r, err := parseRuleFile(opt, i+1, path)
+	for i, path := range []string{globalRulePath(opt), projectRulePath(opt.Repo)} {
+		if path == "" {
+			continue
+		}
+		r, err := parseRuleFile(opt, ruleDepthGlobal+i, path)
 		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
 			switch i {
 			case 0:
 				path = "(global rules)"
 			case 1:
 				path = "(project rules)"
 			}
-
-			ef := &ErrFile{FileName: path}
-
-			switch err := err.(type) {
-			case ErrsParseRule:
-				ef.Errors = make([]error, len(err))
-				for i, e := range err {
-					ef.Errors[i] = e
-				}
-			default:
-				ef.Errors = []error{err}
-			}
-
-			errs = append(errs, ef)
+			errs = append(errs, newErrRuleFile(path, err))
 			continue
 		}
 		rules = append(rules, r...)
 	}
 
-	err = errs
-	return
+	if len(errs) > 0 {
+		return rules, errs
+	}
+	return rules, nil
+}
+
+// getDirRules returns the rules of the given type from the rule file within
+// a directory. The depth of the rules is determined by the depth of subdir.
+// No rules are returned if the directory does not have a rule file.
+func getDirRules(opt *Options, dirname string, subdir []string, typ SyncType) (rules []RulePair, err error) {
+	path := dirRulePath(filepath.Join(dirname, filepath.Join(subdir...)))
+	r, err := parseRuleFile(opt, ruleDepthDir+len(subdir), filepath.Join(opt.Repo, path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, newErrRuleFile(path, err)
+	}
+	return filterRuleType(r, typ), nil
+}
+
+// mergeRules returns a new list of rules where local is merged into
+// inherited. Rules in local take precedence over inherited rules.
+func mergeRules(inherited, local []RulePair) []RulePair {
+	if len(local) == 0 {
+		return inherited
+	}
+	rules := make([]RulePair, 0, len(inherited)+len(local))
+	rules = append(rules, inherited...)
+	rules = append(rules, local...)
+	return rules
 }
@@ -0,0 +1,532 @@
+package rbxfs
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/robloxapi/rbxfile"
+	rbxfile_json "github.com/robloxapi/rbxfile/json"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLoopback is returned when a server is asked to listen on an
+	// address that is not a loopback address, and to requests from such an
+	// address.
+	ErrNotLoopback = errors.New("server must listen on a loopback address")
+	// ErrBadHost is returned to a request whose Host header does not name a
+	// loopback address, such as one made through DNS rebinding.
+	ErrBadHost = errors.New("host must be a loopback address")
+	// ErrBadOrigin is returned to a request made from a web page not served
+	// from a loopback address.
+	ErrBadOrigin = errors.New("origin must be a loopback address")
+	// ErrBadToken is returned to a request that does not give the token of
+	// the server.
+	ErrBadToken = errors.New("missing or incorrect " + TokenHeader + " header")
+)
+
+// TokenHeader is the header of a request that must contain the token of a
+// Server. Browsers do not send custom headers to another origin without a
+// preflight request, which the server does not answer.
+const TokenHeader = "X-Rbxfs-Token"
+
+// Server serves the directories of a repository to a live-sync plugin over
+// HTTP. The following endpoints are provided:
+//
+//   - GET /dirs: Lists the directories of the repository.
+//   - GET /tree/<dir>: Returns the tree of instances built by syncing in the
+//     directory, without writing any files.
+//   - GET /changes?since=<version>: Waits until a directory changes after the
+//     given version, then returns the current version and the changed
+//     directories.
+//   - POST /patch/<dir>: Applies a list of patches to the tree of the
+//     directory, and syncs the result out to the directory.
+//
+// Requests are rejected unless they are made from a loopback address, to a
+// Host that is a loopback address, with no Origin other than a loopback
+// address, and with Token in the TokenHeader header. The body of a patch must
+// have the application/json content type.
+type Server struct {
+	Options *Options
+	// Token is the secret that each request must give in the TokenHeader
+	// header. NewServer sets it to a random value, which must be given to the
+	// plugin.
+	Token string
+	// PollTimeout is the longest time that a request for changes waits
+	// before returning with no changes. Defaults to 30 seconds.
+	PollTimeout time.Duration
+
+	mux *http.ServeMux
+
+	mu      sync.Mutex
+	version uint64
+	changed map[string]uint64
+	wait    chan struct{}
+
+	// dirLocks serializes the requests that read or write each directory, so
+	// that a patch is not built on a tree that another patch has changed.
+	dirMu    sync.Mutex
+	dirLocks map[string]*sync.Mutex
+}
+
+// NewServer returns a Server for the repository of opt.
+func NewServer(opt *Options) *Server {
+	s := &Server{
+		Options:  opt,
+		Token:    newToken(),
+		mux:      http.NewServeMux(),
+		changed:  map[string]uint64{},
+		wait:     make(chan struct{}),
+		dirLocks: map[string]*sync.Mutex{},
+	}
+	s.mux.HandleFunc("/dirs", s.handleDirs)
+	s.mux.HandleFunc("/tree/", s.handleTree)
+	s.mux.HandleFunc("/changes", s.handleChanges)
+	s.mux.HandleFunc("/patch/", s.handlePatch)
+	return s
+}
+
+// newToken returns a random token for a Server.
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Notify marks each directory in dirs as changed, waking any requests
+// waiting for changes.
+func (s *Server) Notify(dirs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	for _, dir := range dirs {
+		s.changed[dir] = s.version
+	}
+	close(s.wait)
+	s.wait = make(chan struct{})
+}
+
+// Watch notifies the server of changes to the files of the repository, until
+// stop is closed. If poll is true, then changes are detected by polling.
+func (s *Server) Watch(stop <-chan struct{}, poll bool) error {
+	opt := s.Options
+	if !pathIsRepo(opt.Repo) {
+		return ErrNotRepo
+	}
+	n := openNotifier(opt, poll, 0)
+	defer n.Close()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case path, ok := <-n.Events():
+			if !ok {
+				return nil
+			}
+			if watchedMeta(path) {
+				s.Notify(getDirsInRepo(opt.Repo)...)
+				continue
+			}
+			parts := strings.SplitN(path, string(filepath.Separator), 2)
+			if len(parts) < 2 || parts[0] == ProjectMetaDir || strings.HasPrefix(parts[0], ".") {
+				continue
+			}
+			s.Notify(parts[0])
+		}
+	}
+}
+
+// ListenAndServe listens on addr, which must be a loopback address, and
+// serves requests with s.
+func (s *Server) ListenAndServe(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return ErrNotLoopback
+	}
+	return http.ListenAndServe(addr, s)
+}
+
+// isLoopbackHost returns whether host, which may have a port, is localhost or
+// a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		writeJSONError(w, http.StatusForbidden, ErrNotLoopback)
+		return
+	}
+	if !isLoopbackHost(r.Host) {
+		writeJSONError(w, http.StatusForbidden, ErrBadHost)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !isLoopbackHost(u.Host) {
+			writeJSONError(w, http.StatusForbidden, ErrBadOrigin)
+			return
+		}
+	}
+	token := r.Header.Get(TokenHeader)
+	if s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		writeJSONError(w, http.StatusForbidden, ErrBadToken)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// requestDir returns the directory named by the path of a request after
+// prefix. The directory must exist within the repository.
+func (s *Server) requestDir(w http.ResponseWriter, r *http.Request, prefix string) (string, bool) {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	for _, dir := range getDirsInRepo(s.Options.Repo) {
+		if dir == name {
+			return dir, true
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown directory %q", name))
+	return "", false
+}
+
+// dirPlaceInRepo returns the place within repo that is synced to dir. If
+// there is no such place, then the place that would be created by syncing in
+// dir is returned.
+func dirPlaceInRepo(repo, dir string) string {
+	for _, place := range getPlacesInRepo(repo) {
+		if getPlaceDir(place) == dir {
+			return place
+		}
+	}
+	return getDirPlace(dir)
+}
+
+// lockDir locks dir for the handling of a request, returning a function that
+// unlocks it.
+func (s *Server) lockDir(dir string) (unlock func()) {
+	s.dirMu.Lock()
+	mu, ok := s.dirLocks[dir]
+	if !ok {
+		mu = &sync.Mutex{}
+		s.dirLocks[dir] = mu
+	}
+	s.dirMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (s *Server) currentVersion() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// buildTree builds the tree of instances of a directory with the sync-in
+// pipeline.
+func (s *Server) buildTree(dir string) (*rbxfile.Root, error) {
+	opt := s.Options
+	rules, err := getStdRules(opt)
+	if err != nil {
+		return nil, err
+	}
+	rules = filterRuleType(rules, SyncIn)
+	sources := &SourceCache{}
+	refs := map[string]*rbxfile.Instance{}
+	actions, err := syncInReadDir(opt, sources, dir, []string{}, rules, refs, nil)
+	if err != nil {
+		return nil, err
+	}
+	return syncInBuildRoot(opt, refs, sources, syncInAnalyzeActions(actions, nil)), nil
+}
+
+func (s *Server) handleDirs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	dirs := getDirsInRepo(s.Options.Repo)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": s.currentVersion(),
+		"dirs":    dirs,
+	})
+}
+
+func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	dir, ok := s.requestDir(w, r, "/tree/")
+	if !ok {
+		return
+	}
+	unlock := s.lockDir(dir)
+	version := s.currentVersion()
+	root, err := s.buildTree(dir)
+	unlock()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	refs := map[string]*rbxfile.Instance{}
+	instances := make([]interface{}, len(root.Instances))
+	for i, obj := range root.Instances {
+		instances[i] = rbxfile_json.InstanceToJSONInterface(obj, refs)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"dir":       dir,
+		"version":   version,
+		"instances": instances,
+	})
+}
+
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	timeout := s.PollTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	s.mu.Lock()
+	wait := s.wait
+	version := s.version
+	s.mu.Unlock()
+	if version <= since {
+		select {
+		case <-wait:
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	version = s.version
+	dirs := []string{}
+	for dir, v := range s.changed {
+		if v > since {
+			dirs = append(dirs, dir)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(dirs)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": version,
+		"dirs":    dirs,
+	})
+}
+
+// Patch is a change to a tree of instances sent to a Server.
+type Patch struct {
+	// Op is the operation to perform:
+	//
+	//   - "set": Sets the properties of the instance at Path.
+	//   - "remove": Removes the instance at Path.
+	//   - "add": Adds Instance as a child of the instance at Path. An empty
+	//     Path adds the instance to the root.
+	Op string `json:"op"`
+	// Path is the path of an instance, as a list of names separated by dots.
+	Path string `json:"path"`
+	// Properties maps the name of a property to an object with "type" and
+	// "value" fields.
+	Properties map[string]struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	} `json:"properties,omitempty"`
+	// Instance is an instance in the form returned by the tree endpoint.
+	Instance json.RawMessage `json:"instance,omitempty"`
+}
+
+// findInstance returns the instance at path within root, or nil if there is
+// no such instance.
+func findInstance(root *rbxfile.Root, path string) (obj *rbxfile.Instance) {
+	children := root.Instances
+	for _, name := range strings.Split(path, ".") {
+		obj = nil
+		for _, child := range children {
+			if child.Name() == name {
+				obj = child
+				break
+			}
+		}
+		if obj == nil {
+			return nil
+		}
+		children = obj.Children
+	}
+	return obj
+}
+
+// applyPatch applies p to root.
+func applyPatch(root *rbxfile.Root, p Patch) error {
+	switch p.Op {
+	case "set":
+		obj := findInstance(root, p.Path)
+		if obj == nil {
+			return fmt.Errorf("instance %q not found", p.Path)
+		}
+		for name, prop := range p.Properties {
+			var value interface{}
+			if err := json.Unmarshal(prop.Value, &value); err != nil {
+				return fmt.Errorf("property %q: %s", name, err)
+			}
+			v := rbxfile_json.ValueFromJSONInterface(rbxfile.TypeFromString(prop.Type), value)
+			if v == nil {
+				return fmt.Errorf("property %q: invalid value of type %q", name, prop.Type)
+			}
+			obj.Properties[name] = v
+		}
+	case "remove":
+		obj := findInstance(root, p.Path)
+		if obj == nil {
+			return fmt.Errorf("instance %q not found", p.Path)
+		}
+		if parent := obj.Parent(); parent != nil {
+			parent.RemoveChild(obj)
+			break
+		}
+		for i, child := range root.Instances {
+			if child == obj {
+				root.Instances = append(root.Instances[:i], root.Instances[i+1:]...)
+				break
+			}
+		}
+	case "add":
+		var iinst interface{}
+		if err := json.Unmarshal(p.Instance, &iinst); err != nil {
+			return fmt.Errorf("instance: %s", err)
+		}
+		refs := map[string]*rbxfile.Instance{}
+		populateRefs(refs, root.Instances)
+		var propRefs []rbxfile.PropRef
+		obj, ok := rbxfile_json.InstanceFromJSONInterface(iinst, refs, &propRefs)
+		if !ok {
+			return errors.New("invalid instance")
+		}
+		if p.Path == "" {
+			root.Instances = append(root.Instances, obj)
+		} else {
+			parent := findInstance(root, p.Path)
+			if parent == nil {
+				return fmt.Errorf("instance %q not found", p.Path)
+			}
+			parent.AddChild(obj)
+		}
+		for _, propRef := range propRefs {
+			rbxfile.ResolveReference(refs, propRef)
+		}
+	default:
+		return fmt.Errorf("unknown patch operation %q", p.Op)
+	}
+	return nil
+}
+
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return
+	}
+	dir, ok := s.requestDir(w, r, "/patch/")
+	if !ok {
+		return
+	}
+	var body struct {
+		Patches []Patch `json:"patches"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	opt := s.Options
+	// The directory is locked from when its tree is read until the patched
+	// tree is written.
+	defer s.lockDir(dir)()
+	root, err := s.buildTree(dir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for i, p := range body.Patches {
+		if err := applyPatch(root, p); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("patch %d: %s", i, err))
+			return
+		}
+	}
+
+	rules, err := getStdRules(opt)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	place := dirPlaceInRepo(opt.Repo, dir)
+	actions, err := syncOutReadRoot(opt, root, place, filterRuleType(rules, SyncOut), nil)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	plan, err := syncOutPlanActions(opt, place, dir, root, syncOutAnalyzeActions(actions, nil))
+	if err == nil {
+		err = syncOutApplyActions(opt, plan)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.Notify(dir)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": s.currentVersion(),
+		"stats":   plan.Stats(),
+	})
+}
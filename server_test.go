@@ -0,0 +1,321 @@
+package rbxfs
+
+import (
+	"encoding/json"
+	"github.com/robloxapi/rbxfile"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer returns a server for a new repository containing the given
+// directories. The repository should be removed by the caller.
+func testServer(t *testing.T, dirs ...string) (*Server, string) {
+	repo, err := ioutil.TempDir("", "rbxfs-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range append(dirs, ProjectMetaDir) {
+		if err := os.Mkdir(filepath.Join(repo, dir), 0777); err != nil {
+			os.RemoveAll(repo)
+			t.Fatal(err)
+		}
+	}
+	return NewServer(&Options{Repo: repo, ConfigDir: filepath.Join(repo, "config")}), repo
+}
+
+// serve makes a request to s as a plugin would: from and to a loopback
+// address, with the token of the server. The request is modified by each of
+// mod before it is made.
+func serve(s *Server, method, target, body string, mod ...func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://127.0.0.1:7000"+target, strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:50000"
+	r.Header.Set(TokenHeader, s.Token)
+	for _, m := range mod {
+		m(r)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerRejects(t *testing.T) {
+	s, repo := testServer(t, "game")
+	defer os.RemoveAll(repo)
+
+	tests := []struct {
+		name string
+		mod  func(r *http.Request)
+		err  error
+	}{
+		{"remote address", func(r *http.Request) { r.RemoteAddr = "192.0.2.1:1234" }, ErrNotLoopback},
+		{"rebound host", func(r *http.Request) { r.Host = "attacker.example:7000" }, ErrBadHost},
+		{"foreign origin", func(r *http.Request) { r.Header.Set("Origin", "http://attacker.example") }, ErrBadOrigin},
+		{"null origin", func(r *http.Request) { r.Header.Set("Origin", "null") }, ErrBadOrigin},
+		{"missing token", func(r *http.Request) { r.Header.Del(TokenHeader) }, ErrBadToken},
+		{"wrong token", func(r *http.Request) { r.Header.Set(TokenHeader, "wrong") }, ErrBadToken},
+	}
+	for _, test := range tests {
+		w := serve(s, "GET", "/dirs", "", test.mod)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusForbidden, w.Code)
+			continue
+		}
+		var body map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if body["error"] != test.err.Error() {
+			t.Errorf("%s: expected error %q, got %q", test.name, test.err, body["error"])
+		}
+	}
+}
+
+func TestServerAccepts(t *testing.T) {
+	s, repo := testServer(t, "game")
+	defer os.RemoveAll(repo)
+
+	tests := []struct {
+		name string
+		mod  func(r *http.Request)
+	}{
+		{"loopback", func(r *http.Request) {}},
+		{"localhost", func(r *http.Request) { r.Host = "localhost:7000" }},
+		{"ipv6", func(r *http.Request) { r.RemoteAddr = "[::1]:50000"; r.Host = "[::1]:7000" }},
+		{"loopback origin", func(r *http.Request) { r.Header.Set("Origin", "http://localhost:7000") }},
+	}
+	for _, test := range tests {
+		if w := serve(s, "GET", "/dirs", "", test.mod); w.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, http.StatusOK, w.Code, w.Body)
+		}
+	}
+}
+
+func TestServerDirs(t *testing.T) {
+	s, repo := testServer(t, "a", "b")
+	defer os.RemoveAll(repo)
+
+	var body struct {
+		Version uint64   `json:"version"`
+		Dirs    []string `json:"dirs"`
+	}
+	decodeResponse(t, serve(s, "GET", "/dirs", ""), &body)
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(body.Dirs, expected) {
+		t.Errorf("expected dirs %q, got %q", expected, body.Dirs)
+	}
+
+	if w := serve(s, "POST", "/dirs", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestServerChanges(t *testing.T) {
+	s, repo := testServer(t, "a", "b")
+	defer os.RemoveAll(repo)
+	s.PollTimeout = 10 * time.Millisecond
+
+	type changes struct {
+		Version uint64   `json:"version"`
+		Dirs    []string `json:"dirs"`
+	}
+	var body changes
+	decodeResponse(t, serve(s, "GET", "/changes?since=0", ""), &body)
+	if expected := (changes{Version: 0, Dirs: []string{}}); !reflect.DeepEqual(body, expected) {
+		t.Errorf("expected %v before changes, got %v", expected, body)
+	}
+
+	s.Notify("b")
+	s.Notify("a")
+	body = changes{}
+	decodeResponse(t, serve(s, "GET", "/changes?since=1", ""), &body)
+	if expected := (changes{Version: 2, Dirs: []string{"a"}}); !reflect.DeepEqual(body, expected) {
+		t.Errorf("expected %v since 1, got %v", expected, body)
+	}
+
+	// A waiting request returns once a directory changes.
+	done := make(chan *httptest.ResponseRecorder)
+	s.PollTimeout = time.Minute
+	go func() { done <- serve(s, "GET", "/changes?since=2", "") }()
+	time.Sleep(10 * time.Millisecond)
+	s.Notify("b")
+	select {
+	case w := <-done:
+		body = changes{}
+		decodeResponse(t, w, &body)
+		if expected := (changes{Version: 3, Dirs: []string{"b"}}); !reflect.DeepEqual(body, expected) {
+			t.Errorf("expected %v since 2, got %v", expected, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request for changes was not woken")
+	}
+
+	if w := serve(s, "GET", "/changes?since=x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestServerPatch(t *testing.T) {
+	s, repo := testServer(t, "game")
+	defer os.RemoveAll(repo)
+
+	jsonType := func(r *http.Request) { r.Header.Set("Content-Type", "application/json") }
+	tests := []struct {
+		name   string
+		method string
+		target string
+		mod    func(r *http.Request)
+		status int
+	}{
+		{"method", "GET", "/patch/game", jsonType, http.StatusMethodNotAllowed},
+		{"content type", "POST", "/patch/game", func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, http.StatusUnsupportedMediaType},
+		{"no content type", "POST", "/patch/game", func(r *http.Request) {}, http.StatusUnsupportedMediaType},
+		{"unknown dir", "POST", "/patch/other", jsonType, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := serve(s, test.method, test.target, `{"patches":[]}`, test.mod); w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body)
+		}
+	}
+}
+
+// treeRepo returns a server for a repository with a place synced to the
+// "game" directory, containing ReplicatedStorage.Shared.Util, a module
+// script, and ReplicatedStorage.Old, a folder. The repository should be
+// removed by the caller.
+func treeRepo(t *testing.T) (*Server, string) {
+	service := rbxfile.NewInstance("ReplicatedStorage", nil)
+	service.IsService = true
+	shared := rbxfile.NewInstance("Folder", service)
+	shared.SetName("Shared")
+	util := rbxfile.NewInstance("ModuleScript", shared)
+	util.SetName("Util")
+	util.Set("Source", rbxfile.ValueProtectedString("return 1"))
+	old := rbxfile.NewInstance("Folder", service)
+	old.SetName("Old")
+
+	repo := syncedRepo(t, "game.rbxl", service)
+	return NewServer(&Options{Repo: repo, ConfigDir: filepath.Join(repo, "config")}), repo
+}
+
+// jsonInstance is an instance in the form returned by the tree endpoint.
+type jsonInstance struct {
+	ClassName  string `json:"class_name"`
+	Properties map[string]struct {
+		Type  string      `json:"type"`
+		Value interface{} `json:"value"`
+	} `json:"properties"`
+	Children []jsonInstance `json:"children"`
+}
+
+// child returns the child of inst with the given name, failing the test if
+// there is no such child.
+func (inst jsonInstance) child(t *testing.T, name string) jsonInstance {
+	for _, child := range inst.Children {
+		if child.Properties["Name"].Value == name {
+			return child
+		}
+	}
+	t.Fatalf("%s has no child %q", inst.ClassName, name)
+	return jsonInstance{}
+}
+
+func TestServerTree(t *testing.T) {
+	s, repo := treeRepo(t)
+	defer os.RemoveAll(repo)
+
+	var body struct {
+		Dir       string         `json:"dir"`
+		Instances []jsonInstance `json:"instances"`
+	}
+	decodeResponse(t, serve(s, "GET", "/tree/game", ""), &body)
+	if body.Dir != "game" {
+		t.Errorf("expected dir %q, got %q", "game", body.Dir)
+	}
+	if len(body.Instances) != 1 || body.Instances[0].ClassName != "ReplicatedStorage" {
+		t.Fatalf("expected ReplicatedStorage, got %+v", body.Instances)
+	}
+	shared := body.Instances[0].child(t, "Shared")
+	if shared.ClassName != "Folder" {
+		t.Errorf("expected Shared to be a Folder, got %s", shared.ClassName)
+	}
+	util := shared.child(t, "Util")
+	if util.ClassName != "ModuleScript" {
+		t.Errorf("expected Util to be a ModuleScript, got %s", util.ClassName)
+	}
+	if source := util.Properties["Source"]; source.Type != "ProtectedString" || source.Value != "return 1" {
+		t.Errorf("unexpected Source of Util: %+v", source)
+	}
+	body.Instances[0].child(t, "Old")
+
+	if w := serve(s, "GET", "/tree/other", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestServerPatchFiles(t *testing.T) {
+	s, repo := treeRepo(t)
+	defer os.RemoveAll(repo)
+
+	patches := `{"patches":[
+		{"op":"set","path":"ReplicatedStorage.Shared.Util","properties":{
+			"Source":{"type":"ProtectedString","value":"return 2"}
+		}},
+		{"op":"add","path":"ReplicatedStorage.Shared","instance":{
+			"class_name":"ModuleScript",
+			"properties":{
+				"Name":{"type":"string","value":"New"},
+				"Source":{"type":"ProtectedString","value":"return 3"}
+			},
+			"children":[]
+		}},
+		{"op":"remove","path":"ReplicatedStorage.Old"}
+	]}`
+	w := serve(s, "POST", "/patch/game", patches, func(r *http.Request) {
+		r.Header.Set("Content-Type", "application/json")
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	dir := filepath.Join(repo, "game", "ReplicatedStorage")
+	for _, file := range []struct{ path, content string }{
+		{filepath.Join(dir, "Shared", "Util", "source.lua"), "return 2"},
+		{filepath.Join(dir, "Shared", "New", "source.lua"), "return 3"},
+	} {
+		b, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(b) != file.content {
+			t.Errorf("expected %s to contain %q, got %q", file.path, file.content, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Old")); !os.IsNotExist(err) {
+		t.Errorf("expected Old to be removed, got %v", err)
+	}
+
+	// A patch of a missing instance is rejected.
+	w = serve(s, "POST", "/patch/game", `{"patches":[{"op":"remove","path":"ReplicatedStorage.Missing"}]}`, func(r *http.Request) {
+		r.Header.Set("Content-Type", "application/json")
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,201 @@
+package rbxfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// StagingDirName is the name of the directory within the project metadata
+// directory where files are written before being moved into place.
+const StagingDirName = "tmp"
+
+func stagingRoot(repo string) string {
+	return filepath.Join(repo, ProjectMetaDir, StagingDirName)
+}
+
+// newStageDir creates a new directory within the staging directory of the
+// repository. The name of the directory starts with prefix, followed by the
+// ID of the current process, so that cleanStaging can tell whether it is
+// still in use.
+func newStageDir(repo, prefix string) (string, error) {
+	root := stagingRoot(repo)
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(root, prefix+strconv.Itoa(os.Getpid())+"-")
+}
+
+// stageOwner returns the ID of the process that created the staging
+// directory of the given name, or false if the name was not made by
+// newStageDir.
+func stageOwner(name string) (pid int, ok bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) < 3 {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(parts[len(parts)-2])
+	return pid, err == nil && pid > 0
+}
+
+// cleanStaging removes anything left in the staging directory by an
+// interrupted sync: entries whose owning process is no longer running, and
+// entries not made by newStageDir. Entries of running processes, including
+// the current one, may be in use by a concurrent sync, watcher, or server,
+// and are kept.
+func cleanStaging(repo string) error {
+	root := stagingRoot(repo)
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var errs ErrMux
+	for _, file := range files {
+		if pid, ok := stageOwner(file.Name()); ok && (pid == os.Getpid() || processExists(pid)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, file.Name())); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// stage writes files to a staging directory, so that they can be moved into
+// place together once every file has been written successfully. Changes
+// made to the repository through a stage can be undone with rollback.
+type stage struct {
+	dir   string
+	n     int
+	files map[string]string
+	// Functions that undo each change made to the repository, in order.
+	undo []func() error
+}
+
+// newStage creates a new staging directory within the repository.
+func newStage(repo, prefix string) (*stage, error) {
+	dir, err := newStageDir(repo, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &stage{dir: dir, files: map[string]string{}}, nil
+}
+
+// tempName returns a new path within the staging directory.
+func (s *stage) tempName() string {
+	s.n++
+	return filepath.Join(s.dir, strconv.Itoa(s.n))
+}
+
+// write writes data to a staged file that will be moved to path.
+func (s *stage) write(path string, data []byte) error {
+	name := s.tempName()
+	if err := ioutil.WriteFile(name, data, 0666); err != nil {
+		return err
+	}
+	s.files[path] = name
+	return nil
+}
+
+// backup keeps the file at path within the staging directory, so that it
+// can be restored by rollback. The file is left in place if the file system
+// allows it.
+func (s *stage) backup(path string) error {
+	name := s.tempName()
+	err := os.Link(path, name)
+	if err != nil && !os.IsNotExist(err) {
+		err = os.Rename(path, name)
+	}
+	if os.IsNotExist(err) {
+		// Restoring means that there is no file.
+		s.undo = append(s.undo, func() error {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.undo = append(s.undo, func() error { return os.Rename(name, path) })
+	return nil
+}
+
+// commit moves the staged file for path into place.
+func (s *stage) commit(path string) error {
+	if err := s.backup(path); err != nil {
+		return err
+	}
+	return os.Rename(s.files[path], path)
+}
+
+// delete removes the file at path, or the directory at path, which must be
+// empty.
+func (s *stage) delete(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		s.undo = append(s.undo, func() error { return os.Mkdir(path, stat.Mode().Perm()) })
+		return nil
+	}
+	if err := s.backup(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// mkdir creates a directory at path, if it does not exist.
+func (s *stage) mkdir(path string) error {
+	if err := os.Mkdir(path, 0777); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	s.undo = append(s.undo, func() error { return os.Remove(path) })
+	return nil
+}
+
+// rollback undoes the changes made by commit, delete, and mkdir, in reverse
+// order.
+func (s *stage) rollback() error {
+	var errs ErrMux
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		if err := s.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.undo = nil
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// remove removes the staging directory, along with any files that were not
+// committed, and any backups. Changes can no longer be rolled back.
+func (s *stage) remove() error {
+	s.undo = nil
+	return os.RemoveAll(s.dir)
+}
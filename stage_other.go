@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package rbxfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processExists returns whether a process with the given ID is running.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 performs only the checks for sending a signal. EPERM means
+	// that the process exists, but belongs to another user.
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
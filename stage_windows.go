@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package rbxfs
+
+import (
+	"os"
+)
+
+// processExists returns whether a process with the given ID is running.
+func processExists(pid int) bool {
+	// FindProcess opens the process, which fails if it does not exist.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
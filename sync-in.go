@@ -1,15 +1,16 @@
 package rbxfs
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/robloxapi/rbxapi"
 	"github.com/robloxapi/rbxapi/dump"
 	"github.com/robloxapi/rbxfile"
 	"github.com/robloxapi/rbxfile/bin"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
 )
 
 type ErrReadDir struct {
@@ -21,28 +22,43 @@ func (err ErrReadDir) Error() string {
 	return fmt.Sprintf("error reading dir %q: %s", err.Dir, err.Err.Error())
 }
 
-func syncInReadDir(opt *Options, cache SourceCache, dirname string, subdir []string, rules []rulePair, refs map[string]*rbxfile.Instance) (actions []InAction, err error) {
+func syncInReadDir(opt *Options, cache *SourceCache, dirname string, subdir []string, rules []RulePair, refs map[string]*rbxfile.Instance, tr *inTracer) (actions []InAction, err error) {
 	defs := opt.RuleDefs
 	if defs == nil {
 		defs = DefaultRuleDefs
 	}
 
-	children := map[string]bool{}
 	jdir := filepath.Join(subdir...)
-	for _, pair := range rules {
-		is, err := defs.CallIn(opt, cache, pair, dirname, jdir, refs)
+
+	if len(subdir) == 0 {
+		syncInDecodeTree(opt, cache, dirname, rules)
+	}
+
+	local, err := getDirRules(opt, dirname, subdir, SyncIn)
+	if err != nil {
+		return nil, &ErrReadDir{Dir: jdir, Err: err}
+	}
+	rules = mergeRules(rules, local)
+
+	tr.visit(opt, dirname, jdir)
+	children := map[string]bool{}
+	for i := range rules {
+		pair := &rules[i]
+		is, err := defs.CallIn(opt, cache, *pair, dirname, jdir, refs)
 		if err != nil {
 			return nil, &ErrReadDir{Dir: jdir, Err: err}
 		}
 		for _, s := range is {
+			tr.claim(pair, filepath.Join(jdir, s.File), s.Ignore)
 			// Scan for directories.
 			if !s.Ignore && len(s.Children) == 1 {
-				if source, ok := cache[filepath.Join(jdir, s.File)]; ok && source.IsDir {
+				if source, ok := cache.Get(filepath.Join(jdir, s.File)); ok && source.IsDir {
 					children[s.File] = true
 				}
 			}
 			actions = append(actions, InAction{
 				Depth:     pair.Depth,
+				Rule:      pair,
 				Dir:       subdir,
 				Selection: []InSelection{s},
 			})
@@ -63,7 +79,7 @@ func syncInReadDir(opt *Options, cache SourceCache, dirname string, subdir []str
 		sub := make([]string, len(subdir)+1)
 		copy(sub, subdir)
 		sub[len(sub)-1] = name
-		a, err := syncInReadDir(opt, cache, dirname, sub, rules, refs)
+		a, err := syncInReadDir(opt, cache, dirname, sub, rules, refs, tr)
 		if err != nil {
 			if err, ok := err.(*ErrReadDir); ok {
 				return nil, err
@@ -76,6 +92,84 @@ func syncInReadDir(opt *Options, cache SourceCache, dirname string, subdir []str
 	return
 }
 
+// syncInDecodeTree decodes every uncached file within dirname that is
+// selected by a pattern of rules, so that files are decoded by a single pool
+// of workers across the whole tree, rather than per rule and directory. Only
+// directories of objects are descended. The results are held by cache until
+// syncInReadDir selects each file. Errors are left to syncInReadDir to
+// report.
+func syncInDecodeTree(opt *Options, cache *SourceCache, dirname string, rules []RulePair) {
+	defs := opt.RuleDefs
+	if defs == nil {
+		defs = DefaultRuleDefs
+	}
+
+	type file struct {
+		subdir, dir, name, pattern string
+	}
+	var files []file
+	seen := map[string]bool{}
+	var walk func(subdir []string, rules []RulePair)
+	walk = func(subdir []string, rules []RulePair) {
+		local, err := getDirRules(opt, dirname, subdir, SyncIn)
+		if err != nil {
+			return
+		}
+		rules = mergeRules(rules, local)
+		jdir := filepath.Join(subdir...)
+		dir := filepath.Join(dirname, jdir)
+		for _, pair := range rules {
+			patternFn, ok := defs.InPattern[pair.Pattern.Name]
+			if !ok {
+				continue
+			}
+			sfile, err := patternFn.Func(opt, pair.Pattern.Args, dir)
+			if err != nil {
+				continue
+			}
+			for _, name := range sfile {
+				relname := filepath.Join(jdir, name)
+				if seen[relname] {
+					continue
+				}
+				seen[relname] = true
+				if _, ok := cache.Get(relname); ok {
+					continue
+				}
+				files = append(files, file{subdir: jdir, dir: dir, name: name, pattern: pair.Pattern.Name})
+			}
+		}
+
+		infos, err := ioutil.ReadDir(filepath.Join(opt.Repo, dir))
+		if err != nil {
+			return
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(opt.Repo, dir, info.Name(), auxDataFileName)); err != nil {
+				continue
+			}
+			sub := make([]string, len(subdir)+1)
+			copy(sub, subdir)
+			sub[len(sub)-1] = info.Name()
+			walk(sub, rules)
+		}
+	}
+	walk([]string{}, rules)
+
+	results := make([]decodeResult, len(files))
+	forEach(getFileWorkers(opt), len(files), func(i int) {
+		results[i] = decodeSource(opt, files[i].pattern, files[i].dir, files[i].name)
+	})
+	decoded := make(map[string]decodeResult, len(files))
+	for i, f := range files {
+		decoded[filepath.Join(f.subdir, f.name)] = results[i]
+	}
+	cache.setDecoded(decoded)
+}
+
 type OrderedInAction struct {
 	Priority int
 	Action   InAction
@@ -123,7 +217,10 @@ func (s SortInSelections) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
-func syncInAnalyzeActions(actions []InAction) []InAction {
+// syncInAnalyzeActions resolves conflicts between actions, and combines them
+// into one action per directory. If tr is not nil, then the outcome of each
+// file is recorded to it.
+func syncInAnalyzeActions(actions []InAction, tr *inTracer) []InAction {
 	// Conflicting Action pass: Resolve multiple actions selecting the same
 	// item. Also separate actions into individual selections.
 	{
@@ -158,6 +255,7 @@ func syncInAnalyzeActions(actions []InAction) []InAction {
 						Priority: i,
 						Action: InAction{
 							Depth: action.Depth,
+							Rule:  action.Rule,
 							Dir:   action.Dir,
 							Selection: []InSelection{InSelection{
 								File:     selection.File,
@@ -176,6 +274,7 @@ func syncInAnalyzeActions(actions []InAction) []InAction {
 						Priority: i,
 						Action: InAction{
 							Depth: action.Depth,
+							Rule:  action.Rule,
 							Dir:   action.Dir,
 							Selection: []InSelection{InSelection{
 								File:       selection.File,
@@ -196,6 +295,7 @@ func syncInAnalyzeActions(actions []InAction) []InAction {
 						Priority: i,
 						Action: InAction{
 							Depth: action.Depth,
+							Rule:  action.Rule,
 							Dir:   action.Dir,
 							Selection: []InSelection{InSelection{
 								File:   selection.File,
@@ -223,6 +323,10 @@ func syncInAnalyzeActions(actions []InAction) []InAction {
 		}
 	}
 
+	// Each action now selects a single item, and is the final outcome of that
+	// item.
+	tr.resolve(actions)
+
 	// Merge pass 1: Combine selections of actions that apply to the same
 	// directory.
 	{
@@ -292,21 +396,8 @@ func syncInAnalyzeActions(actions []InAction) []InAction {
 	return actions
 }
 
-func syncInVerifyActions(opt *Options, dir, place string, refs map[string]*rbxfile.Instance, cache SourceCache, actions []InAction) error {
-	fmt.Printf("sync-in `%s` -> `%s`\n", filepath.Join(opt.Repo, dir), filepath.Join(opt.Repo, place))
-	for i, action := range actions {
-		var sel []string
-		for _, s := range action.Selection {
-			sel = append(sel, fmt.Sprintf("{file: %s; I: %t; C: %v; P: %v; V: %v}",
-				s.File, s.Ignore, s.Children, s.Properties, s.Values,
-			))
-		}
-		fmt.Printf("\t%4d %d; %-24s; sel(%02d): {%s}\n", i, action.Depth, "`"+filepath.Join(action.Dir...)+"`", len(action.Selection), strings.Join(sel, "; "))
-	}
-	return nil
-}
-
-func syncInApplyActions(opt *Options, dir, place string, refs map[string]*rbxfile.Instance, cache SourceCache, actions []InAction) error {
+// syncInBuildRoot assembles the instances selected by actions into a tree.
+func syncInBuildRoot(opt *Options, refs map[string]*rbxfile.Instance, cache *SourceCache, actions []InAction) *rbxfile.Root {
 	datamodel := rbxfile.NewInstance("DataModel", nil)
 	dirMap := map[string]*rbxfile.Instance{"": datamodel}
 	for _, action := range actions {
@@ -316,7 +407,7 @@ func syncInApplyActions(opt *Options, dir, place string, refs map[string]*rbxfil
 				continue
 			}
 
-			source := cache[filepath.Join(subdir, selection.File)]
+			source, _ := cache.Get(filepath.Join(subdir, selection.File))
 			if source.IsDir {
 				dirMap[filepath.Join(subdir, selection.File)] = source.Source.Children[selection.Children[0]]
 			}
@@ -355,10 +446,17 @@ func syncInApplyActions(opt *Options, dir, place string, refs map[string]*rbxfil
 			r(services, child)
 		}
 	}
-	f, _ := os.Open(filepath.Join(opt.Repo, ProjectMetaDir, "services"))
-	services, _ := dump.Decode(f)
-	f.Close()
-	r(services, datamodel)
+	if f, err := os.Open(filepath.Join(opt.Repo, ProjectMetaDir, "services")); err != nil {
+		getReporter(opt).Report(Event{Kind: EventWarning, SyncType: SyncIn, Err: err})
+	} else {
+		services, err := dump.Decode(f)
+		f.Close()
+		if err != nil {
+			getReporter(opt).Report(Event{Kind: EventWarning, SyncType: SyncIn, Err: err})
+		} else {
+			r(services, datamodel)
+		}
+	}
 
 	root := &rbxfile.Root{
 		Instances: make([]*rbxfile.Instance, len(datamodel.Children)),
@@ -366,86 +464,141 @@ func syncInApplyActions(opt *Options, dir, place string, refs map[string]*rbxfil
 	copy(root.Instances, datamodel.Children)
 	datamodel.RemoveAll()
 
-	f, _ = os.Create(filepath.Join(opt.Repo, "new-"+place))
-	err := bin.SerializePlace(f, opt.API, root)
-	f.Close()
+	return root
+}
 
-	return err
+// syncInEncodeRoot serializes root in the place format.
+func syncInEncodeRoot(opt *Options, root *rbxfile.Root) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bin.SerializePlace(&buf, opt.API, root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// syncInPlanActions builds and encodes the place produced by actions, and
+// compares it against the current place file, without writing anything.
+func syncInPlanActions(opt *Options, dir, place string, refs map[string]*rbxfile.Instance, cache *SourceCache, actions []InAction) (*Plan, error) {
+	target := "new-" + place
+	plan := &Plan{SyncType: SyncIn, Name: dir, Target: target}
+	root := syncInBuildRoot(opt, refs, cache, actions)
+	b, err := syncInEncodeRoot(opt, root)
+	if err != nil {
+		return plan, err
+	}
+	instances := make([]string, len(root.Instances))
+	for i, obj := range root.Instances {
+		instances[i] = obj.Name()
+	}
+	plan.addFile(opt.Repo, target, instances, b)
+	return plan, nil
 }
 
-func syncInEncodeRoot() error { return nil }
+// syncInApplyActions writes the place file in plan. The file is written to a
+// staging directory first, so that the place file is replaced only once it
+// has been written completely.
+func syncInApplyActions(opt *Options, plan *Plan) error {
+	st, err := newStage(opt.Repo, "sync-in-")
+	if err != nil {
+		return ErrsFile{{FileName: plan.Target, Action: "staging", Errors: []error{err}}}
+	}
+	defer st.remove()
+	var stats PlanStats
+	for i := range plan.Items {
+		item := &plan.Items[i]
+		stats.add(item.Op)
+		if item.Op == PlanNone {
+			continue
+		}
+		path := filepath.Join(opt.Repo, item.Path)
+		if err := st.write(path, item.data); err != nil {
+			return ErrsFile{{FileName: item.Path, Action: "staging", Instances: item.Instances, Errors: []error{err}}}
+		}
+		if err := st.commit(path); err != nil {
+			return ErrsFile{{FileName: item.Path, Action: "writing", Instances: item.Instances, Errors: []error{err}}}
+		}
+		getReporter(opt).Report(Event{Kind: EventFileWritten, SyncType: SyncIn, Name: plan.Name, Item: item})
+	}
+	getReporter(opt).Report(Event{Kind: EventSyncFinished, SyncType: SyncIn, Name: plan.Name, Target: plan.Target, Stats: &stats})
+	return nil
+}
 
 func getDirPlace(dir string) (place string) {
 	// dir.basename + dir-meta.format
 	return filepath.Base(dir) + ".rbxl"
 }
 
+// SyncInReadRepo syncs each directory in dirNames to a new place file. If
+// dirNames is empty, then all directories in the repository are synced.
 func SyncInReadRepo(opt *Options, dirNames []string) error {
-	if !pathIsRepo(opt.Repo) {
-		return ErrNotRepo
-	}
+	_, err := syncInRepo(opt, dirNames, true)
+	return err
+}
 
-	rules, _ := getStdRules(opt)
+func syncInRepo(opt *Options, dirNames []string, apply bool) ([]*Plan, error) {
+	rules, dirNames, err := loadRepo(opt, dirNames, getDirsInRepo)
+	if err != nil {
+		return nil, err
+	}
 	rules = filterRuleType(rules, SyncIn)
 
-	fmt.Println("RULES:", len(rules))
-	for _, r := range rules {
-		fmt.Printf("\t%s\n", r)
-	}
+	reporter := getReporter(opt)
+	reporter.Report(Event{Kind: EventRulesLoaded, SyncType: SyncIn, Rules: rules})
 
-	if len(dirNames) == 0 {
-		dirNames = getDirsInRepo(opt.Repo)
-	}
-	if len(dirNames) == 0 {
-		return ErrNoFiles
+	if apply {
+		// Leftovers from an interrupted sync are no longer useful.
+		if err := cleanStaging(opt.Repo); err != nil {
+			reporter.Report(Event{Kind: EventWarning, SyncType: SyncIn, Err: err})
+		}
 	}
 
-	type dir struct {
-		name    string
-		place   string
-		sources SourceCache
-		actions []InAction
-		refs    map[string]*rbxfile.Instance
+	plans := make([]*Plan, len(dirNames))
+	kept, err := eachName(opt, dirNames, func(i int, opt *Options) (ok bool, err error) {
+		plans[i], err = syncInDir(opt, dirNames[i], rules, apply)
+		return plans[i] != nil, err
+	})
+	out := make([]*Plan, len(kept))
+	for j, i := range kept {
+		out[j] = plans[i]
 	}
+	return out, err
+}
 
-	dirs := make([]dir, 0, len(dirNames))
-	errs := make(ErrsFile, 0, len(dirNames))
+// syncInDir reads, analyzes, and plans the sync of a single directory,
+// applying the plan if apply is true. The returned plan is nil if the
+// directory could not be planned.
+func syncInDir(opt *Options, name string, rules []RulePair, apply bool) (*Plan, error) {
+	return syncInDirWith(opt, name, rules, apply, &SourceCache{}, map[string]*rbxfile.Instance{})
+}
 
-	for _, name := range dirNames {
-		d := dir{
-			name:    name,
-			place:   getDirPlace(name),
-			sources: SourceCache{},
-			refs:    map[string]*rbxfile.Instance{},
-		}
-		var err error
-		d.actions, err = syncInReadDir(opt, d.sources, name, []string{}, rules, d.refs)
-		if err != nil {
-			errs = append(errs, &ErrFile{FileName: name, Action: "syncing", Errors: []error{err}})
-			continue
-		}
-		d.actions = syncInAnalyzeActions(d.actions)
-		dirs = append(dirs, d)
+// syncInDirWith is like syncInDir, but reads sources from the given cache and
+// references, which may have been populated by a previous sync.
+func syncInDirWith(opt *Options, name string, rules []RulePair, apply bool, sources *SourceCache, refs map[string]*rbxfile.Instance) (*Plan, error) {
+	reporter := getReporter(opt)
+	place := getDirPlace(name)
+	reporter.Report(Event{Kind: EventSyncStarted, SyncType: SyncIn, Name: name, Target: "new-" + place})
+
+	actions, err := syncInReadDir(opt, sources, name, []string{}, rules, refs, nil)
+	if err != nil {
+		reporter.Report(Event{Kind: EventError, SyncType: SyncIn, Name: name, Err: err})
+		return nil, err
 	}
+	actions = syncInAnalyzeActions(actions, nil)
 
-	for _, dir := range dirs {
-		err := syncInVerifyActions(opt, dir.name, dir.place, dir.refs, dir.sources, dir.actions)
-		if err != nil {
-			errs = append(errs, &ErrFile{FileName: dir.name, Action: "syncing", Errors: []error{err}})
-			continue
-		}
+	plan, err := syncInPlanActions(opt, name, place, refs, sources, actions)
+	if err != nil {
+		reporter.Report(Event{Kind: EventError, SyncType: SyncIn, Name: name, Err: err})
+		return nil, err
 	}
-
-	for _, dir := range dirs {
-		err := syncInApplyActions(opt, dir.name, dir.place, dir.refs, dir.sources, dir.actions)
-		if err != nil {
-			errs = append(errs, &ErrFile{FileName: dir.name, Action: "syncing", Errors: []error{err}})
-			continue
-		}
+	for i := range plan.Items {
+		reporter.Report(Event{Kind: EventActionPlanned, SyncType: SyncIn, Name: plan.Name, Item: &plan.Items[i]})
 	}
 
-	if len(errs) > 0 {
-		return errs
+	if apply {
+		if err := syncInApplyActions(opt, plan); err != nil {
+			reporter.Report(Event{Kind: EventError, SyncType: SyncIn, Name: name, Err: err})
+			return plan, err
+		}
 	}
-	return nil
+	return plan, nil
 }
@@ -1,11 +1,14 @@
 package rbxfs
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/robloxapi/rbxapi"
 	"github.com/robloxapi/rbxfile"
 	"github.com/robloxapi/rbxfile/bin"
 	"github.com/robloxapi/rbxfile/xml"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -52,19 +55,38 @@ func (err ErrReadObject) Error() string {
 	return fmt.Sprintf("error reading object %q (%s) [%s]: %s", err.Name, err.ClassName, strings.Join(tree, "."), err.Err.Error())
 }
 
-func syncOutReadObject(opt *Options, obj *rbxfile.Instance, dir []string, rules []rulePair) (actions []OutAction, err error) {
+func syncOutReadObject(opt *Options, obj *rbxfile.Instance, dirname string, dir []string, rules []RulePair, tr *outTracer) (actions []OutAction, err error) {
 	defs := opt.RuleDefs
 	if defs == nil {
 		defs = DefaultRuleDefs
 	}
 
+	// Merge rules from the object's directory, if it already exists. The rule
+	// file is left in place, so that it is used again when syncing in.
+	local, err := getDirRules(opt, dirname, dir, SyncOut)
+	if err != nil {
+		return nil, newErrReadObject(obj, err)
+	}
+	rules = mergeRules(rules, local)
+
+	tr.visit(obj)
 	children := map[int]string{}
-	for _, pair := range rules {
-		om, err := defs.CallOut(opt, pair, obj)
+	for i := range rules {
+		pair := &rules[i]
+		om, rejected, err := defs.callOut(opt, *pair, obj)
 		if err != nil {
 			return nil, newErrReadObject(obj, err)
 		}
+		for _, m := range rejected {
+			tr.reject(pair, m.Selection, m.Reject)
+			getReporter(opt).Report(Event{
+				Kind:     EventRuleRejected,
+				SyncType: SyncOut,
+				Err:      newErrReadObject(obj, fmt.Errorf("rule %s: %s", pair, m.Reject)),
+			})
+		}
 		for _, m := range om {
+			tr.claim(pair, m.Selection)
 			if m.File.IsDir {
 				// Scan for mappings of child objects to directories.
 				for _, s := range m.Selection {
@@ -75,6 +97,7 @@ func syncOutReadObject(opt *Options, obj *rbxfile.Instance, dir []string, rules
 			}
 			actions = append(actions, OutAction{
 				Depth: pair.Depth,
+				Rule:  pair,
 				Dir:   dir,
 				Map:   m,
 			})
@@ -97,7 +120,7 @@ func syncOutReadObject(opt *Options, obj *rbxfile.Instance, dir []string, rules
 		subdir := make([]string, len(dir)+1)
 		copy(subdir, dir)
 		subdir[len(subdir)-1] = name
-		oa, err := syncOutReadObject(opt, child, subdir, rules)
+		oa, err := syncOutReadObject(opt, child, dirname, subdir, rules, tr)
 		if err != nil {
 			if err, ok := err.(*ErrReadObject); ok {
 				return nil, err
@@ -111,6 +134,13 @@ func syncOutReadObject(opt *Options, obj *rbxfile.Instance, dir []string, rules
 }
 
 func decodePlaceFile(name string, api *rbxapi.API) (root *rbxfile.Root, err error) {
+	root, _, err = readPlaceFile(name, api)
+	return root, err
+}
+
+// readPlaceFile decodes the place file at name, also returning the content
+// that was decoded.
+func readPlaceFile(name string, api *rbxapi.API) (root *rbxfile.Root, data []byte, err error) {
 	model := false
 	switch ext := filepath.Ext(name); ext {
 	case ".rbxm", ".rbxmx":
@@ -137,36 +167,55 @@ func decodePlaceFile(name string, api *rbxapi.API) (root *rbxfile.Root, err erro
 			},
 		}
 
-		place, err := os.Open(name)
+		data, err := ioutil.ReadFile(name)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		defer place.Close()
 
-		root, err := s.Deserialize(place)
+		root, err := s.Deserialize(bytes.NewReader(data))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return root, err
+		return root, data, nil
+	default:
+		return nil, nil, ErrUnsupportedFormat{Format: ext}
+	}
+}
+
+// encodePlaceFile writes root to w in the format indicated by the extension
+// of name.
+func encodePlaceFile(w io.Writer, name string, api *rbxapi.API, root *rbxfile.Root) error {
+	switch ext := filepath.Ext(name); ext {
+	case ".rbxl":
+		return bin.SerializePlace(w, api, root)
+	case ".rbxm":
+		return bin.SerializeModel(w, api, root)
+	case ".rbxlx", ".rbxmx":
+		return xml.Serialize(w, api, root)
 	default:
-		return nil, ErrUnsupportedFormat{Format: ext}
+		return ErrUnsupportedFormat{Format: ext}
 	}
 }
 
-func syncOutReadPlace(opt *Options, place string, rules []rulePair) (root *rbxfile.Root, actions []OutAction, err error) {
+func syncOutReadPlace(opt *Options, place string, rules []RulePair, tr *outTracer) (root *rbxfile.Root, actions []OutAction, err error) {
 	root, err = decodePlaceFile(filepath.Join(opt.Repo, place), opt.API)
 	if err != nil {
 		return
 	}
+	actions, err = syncOutReadRoot(opt, root, place, rules, tr)
+	return
+}
 
+// syncOutReadRoot reads actions from the instances in root, which are
+// synced to the directory of place.
+func syncOutReadRoot(opt *Options, root *rbxfile.Root, place string, rules []RulePair, tr *outTracer) (actions []OutAction, err error) {
 	datamodel := rbxfile.NewInstance("DataModel", nil)
 	datamodel.SetName("DataModel")
 	for i, obj := range root.Instances {
 		datamodel.AddChildAt(i, obj)
 	}
 
-	actions, err = syncOutReadObject(opt, datamodel, []string{}, rules)
-	return
+	return syncOutReadObject(opt, datamodel, getPlaceDir(place), []string{}, rules, tr)
 }
 
 type OrderedOutAction struct {
@@ -251,13 +300,17 @@ func getDirOutActionObject(action OutAction) *rbxfile.Instance {
 	return sel.Object.Children[sel.Children[0]]
 }
 
-func syncOutAnalyzeActions(actions []OutAction) []OutAction {
+// syncOutAnalyzeActions resolves conflicts between actions, and combines them
+// into one action per file. If tr is not nil, then the outcome of each
+// resolved item is recorded to it.
+func syncOutAnalyzeActions(actions []OutAction, tr *outTracer) []OutAction {
 	// Valid Directory pass: Filter out actions that are not valid for
 	// creating directories.
 	{
 		out := make([]OutAction, 0, len(actions))
 		for _, action := range actions {
 			if action.Map.File.IsDir && getDirOutActionObject(action) == nil {
+				tr.rejectAction(action, "directory must select exactly one child")
 				continue
 			}
 			out = append(out, action)
@@ -305,6 +358,7 @@ func syncOutAnalyzeActions(actions []OutAction) []OutAction {
 			for i := 0; i < max; i++ {
 				path := getOutActionPath(action, i)
 				if item, ok := dirs[path]; ok && item.conflict {
+					tr.rejectAction(action, fmt.Sprintf("directory %q created by multiple objects", path))
 					continue Dir
 				}
 			}
@@ -340,6 +394,7 @@ func syncOutAnalyzeActions(actions []OutAction) []OutAction {
 						Priority: i,
 						Action: OutAction{
 							Depth: action.Depth,
+							Rule:  action.Rule,
 							Dir:   action.Dir,
 							Map: OutMap{
 								File: action.Map.File,
@@ -360,6 +415,7 @@ func syncOutAnalyzeActions(actions []OutAction) []OutAction {
 						Priority: i,
 						Action: OutAction{
 							Depth: action.Depth,
+							Rule:  action.Rule,
 							Dir:   action.Dir,
 							Map: OutMap{
 								File: action.Map.File,
@@ -402,7 +458,8 @@ func syncOutAnalyzeActions(actions []OutAction) []OutAction {
 	Subdir:
 		for _, action := range actions {
 			for i := 1; i < getOutActionPathMaxDepth(action)-1; i++ {
-				if !dirs[getOutActionPath(action, i)] {
+				if path := getOutActionPath(action, i); !dirs[path] {
+					tr.rejectAction(action, fmt.Sprintf("parent directory %q is not created", path))
 					continue Subdir
 				}
 			}
@@ -411,6 +468,10 @@ func syncOutAnalyzeActions(actions []OutAction) []OutAction {
 		actions = out
 	}
 
+	// Each remaining action selects a single item, and is the final outcome
+	// of that item.
+	tr.resolve(actions)
+
 	// Merge pass 1: Combine selections of actions that apply to the same file,
 	// such that there is one action per file.
 	{
@@ -472,75 +533,362 @@ func syncOutAnalyzeActions(actions []OutAction) []OutAction {
 	return actions
 }
 
-func syncOutVerifyActions(opt *Options, place, dir string, root *rbxfile.Root, actions []OutAction) error {
-	fmt.Printf("sync-out `%s` -> `%s`\n", filepath.Join(opt.Repo, place), filepath.Join(opt.Repo, dir))
-	for i, action := range actions {
-		sub := filepath.Join(action.Dir...)
-		path := filepath.Join(dir, sub, action.Map.File.Name)
-		var typ string
-		if action.Map.File.IsDir {
-			typ = "dir "
-		} else {
-			typ = "file"
+// outSelectionPaths returns the paths of the instances selected by sels.
+func outSelectionPaths(sels []OutSelection) []string {
+	var paths []string
+	for _, sel := range sels {
+		if len(sel.Properties) > 0 {
+			paths = append(paths, instancePath(sel.Object))
 		}
-		var sel []string
-		for _, s := range action.Map.Selection {
-			sel = append(sel, fmt.Sprintf("{obj: %p; C: %v; P: %v}",
-				s.Object, s.Children, s.Properties,
-			))
+		for _, child := range sel.Children {
+			paths = append(paths, instancePath(sel.Object.Children[child]))
 		}
-		fmt.Printf("\t%4d %d; %s: %-43s; sel(%02d): {%s}\n", i, action.Depth, typ, path, len(action.Map.Selection), strings.Join(sel, "; "))
 	}
-	return nil
+	return paths
 }
 
-func syncOutApplyActions(opt *Options, place, dir string, root *rbxfile.Root, actions []OutAction) error {
-	if err := os.Mkdir(filepath.Join(opt.Repo, dir), 0666); err != nil && !os.IsExist(err) {
-		fmt.Printf("ERROR: %s\n", err)
-		return nil
+// syncOutPlanActions encodes the content of each file produced by actions,
+// and compares it against the files currently in dir, without writing
+// anything.
+func syncOutPlanActions(opt *Options, place, dir string, root *rbxfile.Root, actions []OutAction) (*Plan, error) {
+	plan := &Plan{SyncType: SyncOut, Name: place, Target: dir}
+	plan.addDir(opt.Repo, dir, nil)
+
+	// Encoders may assign references to instances that do not have one, so
+	// every reference is assigned beforehand to allow files to be encoded
+	// concurrently.
+	if root != nil {
+		populateRefs(map[string]*rbxfile.Instance{}, root.Instances)
 	}
-	for i, action := range actions {
+
+	type result struct {
+		items []PlanItem
+		err   *ErrFile
+	}
+	results := make([]result, len(actions))
+	forEach(getFileWorkers(opt), len(actions), func(i int) {
+		action := actions[i]
 		if action.Map.File.Name == "" {
 			// Ignore.
-			continue
+			return
 		}
 		sub := filepath.Join(action.Dir...)
 		path := filepath.Join(dir, sub, action.Map.File.Name)
-		abspath := filepath.Join(opt.Repo, path)
+		instances := outSelectionPaths(action.Map.Selection)
+		var items []PlanItem
+		var err error
 		if action.Map.File.IsDir {
-			if err := os.Mkdir(abspath, 0666); err != nil && !os.IsExist(err) {
-				fmt.Printf("ERROR (%d): %s\n", i, err)
-				continue
+			items = append(items, newDirItem(opt.Repo, path, instances))
+			var b []byte
+			if b, err = encodeAuxData(getDirOutActionObject(action)); err == nil {
+				items = append(items, newFileItem(opt.Repo, filepath.Join(path, auxDataFileName), instances, b))
 			}
-			sel := action.Map.Selection[0]
-			obj := sel.Object.Children[sel.Children[0]]
+		} else if format := getFormats(opt).FromFileName(path); format == nil {
+			err = ErrUnsupportedFormat{Format: filepath.Ext(path)}
+		} else {
+			format.SetAPI(opt.API)
+			var buf bytes.Buffer
+			if err = format.Encode(&buf, action.Map.Selection); err == nil {
+				items = append(items, newFileItem(opt.Repo, path, instances, buf.Bytes()))
+			}
+		}
+		if err != nil {
+			results[i].err = &ErrFile{FileName: path, Action: "encoding", Instances: instances, Errors: []error{err}}
+			return
+		}
+		results[i].items = items
+	})
+
+	errs := ErrsFile{}
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			if opt.FailFast {
+				break
+			}
+			continue
+		}
+		plan.Items = append(plan.Items, r.items...)
+	}
+	// A plan with errors is never applied, so there is no need to look for
+	// stale files.
+	if len(errs) == 0 {
+		produced := make(map[string]bool, len(plan.Items))
+		for _, item := range plan.Items {
+			produced[item.Path] = true
+			plan.manifest = append(plan.manifest, item.Path)
+		}
+		var err error
+		if opt.KeepStale {
+			err = syncOutKeepStale(opt, plan, produced)
+		} else {
+			var inRules []RulePair
+			if inRules, err = getStdRules(opt); err == nil {
+				err = syncOutPlanStale(opt, plan, filterRuleType(inRules, SyncIn), produced)
+			}
+		}
+		if err != nil {
+			errs = append(errs, &ErrFile{FileName: dir, Action: "reading", Errors: []error{err}})
+		}
+	}
+	if len(errs) > 0 {
+		return plan, errs
+	}
+	return plan, nil
+}
 
-			if err := writeAuxData(abspath, obj); err != nil {
-				fmt.Printf("ERROR (%d): %s\n", i, err)
+// syncOutKeepStale adds to the manifest of plan each path that is listed by
+// the current manifest of the place, is not in produced, and still exists, so
+// that stale paths kept by KeepStale can be removed by a later sync-out.
+func syncOutKeepStale(opt *Options, plan *Plan, produced map[string]bool) error {
+	listed, err := readManifest(opt.Repo, plan.Name)
+	if err != nil {
+		return err
+	}
+	for _, path := range listed {
+		if produced[path] {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(opt.Repo, path)); err == nil {
+			plan.manifest = append(plan.manifest, path)
+		}
+	}
+	return nil
+}
+
+// syncOutPlanStale adds to plan the deletion of each path within the target
+// directory that is listed by the manifest of the place, but is not in
+// produced. Only paths written by a previous sync-out are listed, so files
+// added by hand are kept. Listed paths selected by an in rule with the Ignore
+// filter are also kept, as are directories that still contain anything that
+// is kept. inRules are the in rules that apply to the target directory.
+func syncOutPlanStale(opt *Options, plan *Plan, inRules []RulePair, produced map[string]bool) error {
+	listed, err := readManifest(opt.Repo, plan.Name)
+	if err != nil {
+		return err
+	}
+	dir := plan.Target
+	prefix := dir + string(filepath.Separator)
+	var stale []string
+	for _, path := range listed {
+		if !produced[path] && strings.HasPrefix(path, prefix) {
+			stale = append(stale, path)
+		}
+	}
+	// The contents of a directory sort after it, so they are visited first.
+	sort.Sort(sort.Reverse(sort.StringSlice(stale)))
+
+	// Returns the in rules that apply to the given subdirectory.
+	rules := map[string][]RulePair{}
+	var rulesAt func(subdir []string) ([]RulePair, error)
+	rulesAt = func(subdir []string) ([]RulePair, error) {
+		key := filepath.Join(subdir...)
+		if r, ok := rules[key]; ok {
+			return r, nil
+		}
+		r := inRules
+		if len(subdir) > 0 {
+			var err error
+			if r, err = rulesAt(subdir[:len(subdir)-1]); err != nil {
+				return nil, err
+			}
+		}
+		local, err := getDirRules(opt, dir, subdir, SyncIn)
+		if err != nil {
+			return nil, err
+		}
+		r = mergeRules(r, local)
+		rules[key] = r
+		return r, nil
+	}
+	// Returns whether the path, or any directory containing it, is ignored.
+	ignoredIn := map[string]map[string]bool{}
+	isIgnored := func(path string) (bool, error) {
+		parts := strings.Split(path[len(prefix):], string(filepath.Separator))
+		for i := range parts {
+			key := filepath.Join(parts[:i]...)
+			ignored, ok := ignoredIn[key]
+			if !ok {
+				r, err := rulesAt(parts[:i])
+				if err != nil {
+					return false, err
+				}
+				if ignored, err = syncOutIgnored(opt, filepath.Join(dir, key), r); err != nil {
+					return false, err
+				}
+				ignoredIn[key] = ignored
+			}
+			if ignored[parts[i]] {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	deleted := map[string]bool{}
+	for _, path := range stale {
+		if filepath.Base(path) == DirRulesFileName {
+			continue
+		}
+		stat, err := os.Lstat(filepath.Join(opt.Repo, path))
+		if err != nil {
+			if os.IsNotExist(err) {
 				continue
 			}
-		} else {
-			ext := filepath.Ext(abspath)
-			format := GetFormatFromExt(strings.TrimPrefix(ext, "."))
-			if format == nil {
-				fmt.Printf("ERROR (%d): %s `%s`\n", i, "unknown format extension", ext)
+			return err
+		}
+		if ignored, err := isIgnored(path); err != nil {
+			return err
+		} else if ignored {
+			continue
+		}
+		if stat.IsDir() {
+			files, err := ioutil.ReadDir(filepath.Join(opt.Repo, path))
+			if err != nil {
+				return err
+			}
+			keep := false
+			for _, file := range files {
+				if !deleted[filepath.Join(path, file.Name())] {
+					keep = true
+					break
+				}
+			}
+			if keep {
 				continue
 			}
-			format.SetAPI(opt.API)
+		}
+		deleted[path] = true
+		plan.Items = append(plan.Items, PlanItem{Op: PlanDelete, Path: path, IsDir: stat.IsDir()})
+	}
+	return nil
+}
 
-			f, err := os.Create(abspath)
+// syncOutIgnored returns the names of the files within dir that are selected
+// by an in rule with the Ignore filter.
+func syncOutIgnored(opt *Options, dir string, inRules []RulePair) (map[string]bool, error) {
+	defs := opt.RuleDefs
+	if defs == nil {
+		defs = DefaultRuleDefs
+	}
+	ignored := map[string]bool{}
+	for _, pair := range inRules {
+		if pair.Filter.Name != "Ignore" {
+			continue
+		}
+		pattern, ok := defs.InPattern[pair.Pattern.Name]
+		if !ok {
+			return nil, ErrUnknownSyncFunc{SyncType: SyncIn, FuncType: Pattern, Name: pair.Pattern.Name}
+		}
+		files, err := pattern.Func(opt, pair.Pattern.Args, dir)
+		if err != nil {
+			return nil, ErrSyncFunc{SyncType: SyncIn, FuncType: Pattern, Name: pair.Pattern.Name, Err: err}
+		}
+		for _, name := range files {
+			ignored[name] = true
+		}
+	}
+	return ignored, nil
+}
+
+// syncOutApplyActions writes the files and directories in plan. Items that
+// are unchanged are not written. Changed files are first written to a
+// staging directory, and are moved into place only if every file was written
+// successfully. If moving any item into place fails, then the items already
+// moved are restored, so that a failure does not leave the target
+// half-written. Failures are returned as an ErrsFile.
+func syncOutApplyActions(opt *Options, plan *Plan) error {
+	reporter := getReporter(opt)
+	errs := ErrsFile{}
+	fail := func(item *PlanItem, action string, err error) {
+		reporter.Report(Event{Kind: EventError, SyncType: SyncOut, Name: plan.Name, Item: item, Err: err})
+		errs = append(errs, &ErrFile{FileName: item.Path, Action: action, Instances: item.Instances, Errors: []error{err}})
+	}
+
+	st, err := newStage(opt.Repo, "sync-out-")
+	if err != nil {
+		return ErrsFile{{FileName: plan.Target, Action: "staging", Errors: []error{err}}}
+	}
+	defer st.remove()
+	for i := range plan.Items {
+		item := &plan.Items[i]
+		if item.IsDir || item.Op == PlanNone || item.Op == PlanDelete {
+			continue
+		}
+		if err := st.write(filepath.Join(opt.Repo, item.Path), item.data); err != nil {
+			fail(item, "staging", err)
+			if opt.FailFast {
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		// Nothing has been changed yet.
+		return errs
+	}
+	// The manifest is committed along with the files that it lists.
+	var manifest string
+	if plan.manifest != nil {
+		path := manifestPath(opt.Repo, plan.Name)
+		b := encodeManifest(plan.manifest)
+		if old, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(old, b) {
+			err := os.MkdirAll(filepath.Dir(path), 0777)
+			if err == nil {
+				err = st.write(path, b)
+			}
 			if err != nil {
-				fmt.Printf("ERROR (%d): %s\n", i, err)
-				continue
+				return ErrsFile{{FileName: plan.Target, Action: "staging manifest", Errors: []error{err}}}
 			}
-			if err := format.Encode(f, action.Map.Selection); err != nil {
-				fmt.Printf("ERROR (%d): %s\n", i, err)
-				f.Close()
-				continue
+			manifest = path
+		}
+	}
+
+	var stats PlanStats
+	for i := range plan.Items {
+		item := &plan.Items[i]
+		if item.Op == PlanNone {
+			stats.add(PlanNone)
+			continue
+		}
+		abspath := filepath.Join(opt.Repo, item.Path)
+		var action string
+		var err error
+		switch {
+		case item.Op == PlanDelete:
+			// Directories are deleted only after their contents.
+			action = "deleting"
+			err = st.delete(abspath)
+		case item.IsDir:
+			action = "creating directory"
+			err = st.mkdir(abspath)
+		default:
+			action = "writing"
+			err = st.commit(abspath)
+		}
+		if err != nil {
+			fail(item, action, err)
+			if err := st.rollback(); err != nil {
+				errs = append(errs, &ErrFile{FileName: plan.Target, Action: "rolling back", Errors: []error{err}})
 			}
-			f.Close()
+			return errs
+		}
+		stats.add(item.Op)
+	}
+	if manifest != "" {
+		if err := st.commit(manifest); err != nil {
+			errs = append(errs, &ErrFile{FileName: plan.Target, Action: "writing manifest", Errors: []error{err}})
+			if err := st.rollback(); err != nil {
+				errs = append(errs, &ErrFile{FileName: plan.Target, Action: "rolling back", Errors: []error{err}})
+			}
+			return errs
+		}
+	}
+	for i := range plan.Items {
+		if item := &plan.Items[i]; item.Op != PlanNone {
+			reporter.Report(Event{Kind: EventFileWritten, SyncType: SyncOut, Name: plan.Name, Item: item})
 		}
 	}
+	reporter.Report(Event{Kind: EventSyncFinished, SyncType: SyncOut, Name: plan.Name, Target: plan.Target, Stats: &stats})
 	return nil
 }
 
@@ -549,69 +897,81 @@ func getPlaceDir(place string) string {
 	return filepath.Join(filepath.Dir(place), b[:len(b)-len(filepath.Ext(place))])
 }
 
+// SyncOutReadRepo syncs each place in placeNames to its corresponding
+// directory. If placeNames is empty, then all places in the repository are
+// synced.
 func SyncOutReadRepo(opt *Options, placeNames []string) error {
-	if !pathIsRepo(opt.Repo) {
-		return ErrNotRepo
-	}
+	_, err := syncOutRepo(opt, placeNames, true)
+	return err
+}
 
-	rules, _ := getStdRules(opt)
+func syncOutRepo(opt *Options, placeNames []string, apply bool) ([]*Plan, error) {
+	rules, placeNames, err := loadRepo(opt, placeNames, getPlacesInRepo)
+	if err != nil {
+		return nil, err
+	}
 	rules = filterRuleType(rules, SyncOut)
 
-	fmt.Println("RULES:", len(rules))
-	for _, r := range rules {
-		fmt.Printf("\t%s\n", r)
-	}
+	reporter := getReporter(opt)
+	reporter.Report(Event{Kind: EventRulesLoaded, SyncType: SyncOut, Rules: rules})
 
-	if len(placeNames) == 0 {
-		placeNames = getPlacesInRepo(opt.Repo)
-	}
-	if len(placeNames) == 0 {
-		return ErrNoFiles
+	if apply {
+		// Leftovers from an interrupted sync are no longer useful.
+		if err := cleanStaging(opt.Repo); err != nil {
+			reporter.Report(Event{Kind: EventWarning, SyncType: SyncOut, Err: err})
+		}
 	}
 
-	type place struct {
-		name    string
-		dir     string
-		root    *rbxfile.Root
-		actions []OutAction
+	plans := make([]*Plan, len(placeNames))
+	kept, err := eachName(opt, placeNames, func(i int, opt *Options) (ok bool, err error) {
+		plans[i], err = syncOutPlace(opt, placeNames[i], rules, apply)
+		return plans[i] != nil, err
+	})
+	out := make([]*Plan, len(kept))
+	for j, i := range kept {
+		out[j] = plans[i]
 	}
+	return out, err
+}
 
-	places := make([]place, 0, len(placeNames))
-	errs := make(ErrsFile, 0, len(placeNames))
-
-	for _, name := range placeNames {
-		p := place{
-			name: name,
-			dir:  getPlaceDir(name),
-		}
-		var err error
-		p.root, p.actions, err = syncOutReadPlace(opt, name, rules)
-		if err != nil {
-			errs = append(errs, &ErrFile{FileName: name, Action: "syncing", Errors: []error{err}})
-			continue
-		}
-		p.actions = syncOutAnalyzeActions(p.actions)
-		places = append(places, p)
+// syncOutPlace reads, analyzes, and plans the sync of a single place,
+// applying the plan if apply is true. The returned plan is nil if the place
+// could not be planned.
+func syncOutPlace(opt *Options, name string, rules []RulePair, apply bool) (*Plan, error) {
+	reporter := getReporter(opt)
+	dir := getPlaceDir(name)
+	reporter.Report(Event{Kind: EventSyncStarted, SyncType: SyncOut, Name: name, Target: dir})
+
+	// The content is kept so that the snapshot records exactly what was
+	// synced, even if the place file changes in the meantime.
+	root, data, err := readPlaceFile(filepath.Join(opt.Repo, name), opt.API)
+	var actions []OutAction
+	if err == nil {
+		actions, err = syncOutReadRoot(opt, root, name, rules, nil)
 	}
-
-	for _, place := range places {
-		err := syncOutVerifyActions(opt, place.name, place.dir, place.root, place.actions)
-		if err != nil {
-			errs = append(errs, &ErrFile{FileName: place.name, Action: "syncing", Errors: []error{err}})
-			continue
-		}
+	if err != nil {
+		reporter.Report(Event{Kind: EventError, SyncType: SyncOut, Name: name, Err: err})
+		return nil, err
 	}
+	actions = syncOutAnalyzeActions(actions, nil)
 
-	for _, place := range places {
-		err := syncOutApplyActions(opt, place.name, place.dir, place.root, place.actions)
-		if err != nil {
-			errs = append(errs, &ErrFile{FileName: place.name, Action: "syncing", Errors: []error{err}})
-			continue
-		}
+	plan, err := syncOutPlanActions(opt, name, dir, root, actions)
+	if err != nil {
+		reporter.Report(Event{Kind: EventError, SyncType: SyncOut, Name: name, Err: err})
+		return nil, err
+	}
+	for i := range plan.Items {
+		reporter.Report(Event{Kind: EventActionPlanned, SyncType: SyncOut, Name: plan.Name, Item: &plan.Items[i]})
 	}
 
-	if len(errs) > 0 {
-		return errs
+	if apply {
+		if err := syncOutApplyActions(opt, plan); err != nil {
+			return plan, err
+		}
+		// The synced place becomes the base of later merges.
+		if err := writeSnapshot(opt, name, data); err != nil {
+			reporter.Report(Event{Kind: EventWarning, SyncType: SyncOut, Name: name, Err: err})
+		}
 	}
-	return nil
+	return plan, nil
 }
@@ -0,0 +1,462 @@
+package rbxfs
+
+import (
+	"fmt"
+	"github.com/robloxapi/rbxfile"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Trace describes how rules were applied to each item of a single place or
+// directory.
+type Trace struct {
+	SyncType SyncType
+	// Name is the name of the place when syncing out, or the directory when
+	// syncing in.
+	Name  string
+	Items []TraceItem
+}
+
+// TraceItem describes the outcome of a single item. When syncing out, an item
+// is a child or property of an object. When syncing in, an item is a file.
+type TraceItem struct {
+	// Object is the path of the object containing the item. Empty when
+	// syncing in.
+	Object string
+	// Child is the index of the item within the children of Object, or -1 if
+	// the item is not a child.
+	Child int
+	// Name is the name of the child or property. When syncing in, Name is the
+	// path of the file, relative to the synced directory.
+	Name string
+	// File is the path of the file to which the item is written. Empty when
+	// syncing in, or if the item is not written.
+	File string
+	// Rule is the rule that claimed the item, if any.
+	Rule *RulePair
+	// Overridden is a list of rules that matched the item, but were
+	// overridden by another rule.
+	Overridden []RulePair
+	// Rejected is a list of rules that matched the item, but could not be
+	// applied.
+	Rejected []TraceRejection
+	// Dropped describes why the item is not synced. Empty if the item is
+	// synced.
+	Dropped string
+}
+
+// TraceRejection describes why a rule could not be applied to an item.
+type TraceRejection struct {
+	Rule   RulePair
+	Reason string
+}
+
+// label returns a short description of the item.
+func (item TraceItem) label(typ SyncType) string {
+	if typ == SyncIn {
+		return item.Name
+	}
+	path := item.Name
+	if item.Object != "" {
+		path = item.Object + "." + item.Name
+	}
+	if item.Child < 0 {
+		return path + " [property]"
+	}
+	return fmt.Sprintf("%s [child %d]", path, item.Child)
+}
+
+// WriteReport writes a human-readable report of the trace to w.
+func (t *Trace) WriteReport(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "sync-%s %q\n", t.SyncType, t.Name); err != nil {
+		return err
+	}
+	for _, item := range t.Items {
+		lines := make([]string, 0, 2+len(item.Overridden)+len(item.Rejected))
+		switch {
+		case item.Dropped != "":
+			lines = append(lines, fmt.Sprintf("\t%s: dropped: %s", item.label(t.SyncType), item.Dropped))
+		case item.File != "":
+			lines = append(lines, fmt.Sprintf("\t%s: %s", item.label(t.SyncType), item.File))
+		default:
+			lines = append(lines, fmt.Sprintf("\t%s", item.label(t.SyncType)))
+		}
+		if item.Rule != nil {
+			lines = append(lines, fmt.Sprintf("\t\tmatched:    %s", item.Rule))
+		}
+		for _, rule := range item.Overridden {
+			lines = append(lines, fmt.Sprintf("\t\toverridden: %s", rule))
+		}
+		for _, r := range item.Rejected {
+			lines = append(lines, fmt.Sprintf("\t\trejected:   %s (%s)", r.Rule, r.Reason))
+		}
+		if _, err := io.WriteString(w, strings.Join(lines, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instancePath returns the names of the ancestors of obj, followed by the
+// name of obj, separated by dots. The root object is not included.
+func instancePath(obj *rbxfile.Instance) string {
+	var names []string
+	for ; obj != nil && obj.Parent() != nil; obj = obj.Parent() {
+		names = append(names, obj.Name())
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, ".")
+}
+
+////////////////////////////////////////////////////////////////
+
+type traceClaim struct {
+	rule   *RulePair
+	reject string
+}
+
+type outTraceKey struct {
+	obj   *rbxfile.Instance
+	child int
+	prop  string
+}
+
+type outTraceItem struct {
+	claims  []traceClaim
+	winner  *RulePair
+	file    string
+	ignored bool
+}
+
+// outTracer records the outcome of each item when syncing out. A nil
+// *outTracer records nothing.
+type outTracer struct {
+	dir   string
+	keys  []outTraceKey
+	items map[outTraceKey]*outTraceItem
+}
+
+func newOutTracer(dir string) *outTracer {
+	return &outTracer{dir: dir, items: map[outTraceKey]*outTraceItem{}}
+}
+
+func (tr *outTracer) get(key outTraceKey) *outTraceItem {
+	item, ok := tr.items[key]
+	if !ok {
+		item = &outTraceItem{}
+		tr.items[key] = item
+		tr.keys = append(tr.keys, key)
+	}
+	return item
+}
+
+// each calls fn for each item selected by sels.
+func (tr *outTracer) each(sels []OutSelection, fn func(*outTraceItem)) {
+	for _, sel := range sels {
+		for _, child := range sel.Children {
+			fn(tr.get(outTraceKey{obj: sel.Object, child: child}))
+		}
+		for _, prop := range sel.Properties {
+			fn(tr.get(outTraceKey{obj: sel.Object, child: -1, prop: prop}))
+		}
+	}
+}
+
+// visit adds each child and property of obj as an item.
+func (tr *outTracer) visit(obj *rbxfile.Instance) {
+	if tr == nil {
+		return
+	}
+	for i := range obj.Children {
+		tr.get(outTraceKey{obj: obj, child: i})
+	}
+	props := make([]string, 0, len(obj.Properties))
+	for name := range obj.Properties {
+		props = append(props, name)
+	}
+	sort.Strings(props)
+	for _, name := range props {
+		tr.get(outTraceKey{obj: obj, child: -1, prop: name})
+	}
+}
+
+// claim records that rule matched the selected items.
+func (tr *outTracer) claim(rule *RulePair, sels []OutSelection) {
+	if tr == nil {
+		return
+	}
+	tr.each(sels, func(item *outTraceItem) {
+		item.claims = append(item.claims, traceClaim{rule: rule})
+	})
+}
+
+// reject records that rule matched the selected items, but could not be
+// applied.
+func (tr *outTracer) reject(rule *RulePair, sels []OutSelection, reason string) {
+	if tr == nil {
+		return
+	}
+	tr.each(sels, func(item *outTraceItem) {
+		item.claims = append(item.claims, traceClaim{rule: rule, reject: reason})
+	})
+}
+
+// rejectAction records that a previously claimed action was removed.
+func (tr *outTracer) rejectAction(action OutAction, reason string) {
+	if tr == nil {
+		return
+	}
+	tr.each(action.Map.Selection, func(item *outTraceItem) {
+		for i := len(item.claims) - 1; i >= 0; i-- {
+			if c := &item.claims[i]; c.rule == action.Rule && c.reject == "" {
+				c.reject = reason
+				break
+			}
+		}
+	})
+}
+
+// resolve records the final actions of each item.
+func (tr *outTracer) resolve(actions []OutAction) {
+	if tr == nil {
+		return
+	}
+	for _, action := range actions {
+		tr.each(action.Map.Selection, func(item *outTraceItem) {
+			item.winner = action.Rule
+			item.ignored = action.Map.File.Name == ""
+			if !item.ignored {
+				item.file = filepath.Join(tr.dir, getOutActionPath(action, 0))
+			}
+		})
+	}
+}
+
+func (tr *outTracer) trace(name string) *Trace {
+	t := &Trace{SyncType: SyncOut, Name: name, Items: make([]TraceItem, 0, len(tr.keys))}
+	for _, key := range tr.keys {
+		item := tr.items[key]
+		ti := TraceItem{
+			Object: instancePath(key.obj),
+			Child:  key.child,
+			Name:   key.prop,
+			File:   item.file,
+		}
+		if key.child >= 0 && key.child < len(key.obj.Children) {
+			ti.Name = key.obj.Children[key.child].Name()
+		}
+		if item.winner != nil {
+			rule := *item.winner
+			ti.Rule = &rule
+		}
+		for _, c := range item.claims {
+			switch {
+			case c.reject != "":
+				ti.Rejected = append(ti.Rejected, TraceRejection{Rule: *c.rule, Reason: c.reject})
+			case c.rule != item.winner:
+				ti.Overridden = append(ti.Overridden, *c.rule)
+			}
+		}
+		switch {
+		case len(item.claims) == 0:
+			ti.Dropped = "no matching rule"
+		case item.winner == nil && len(ti.Overridden) == 0:
+			ti.Dropped = "rejected by all matching rules"
+		case item.winner == nil:
+			ti.Dropped = "overriding rule was rejected"
+		case item.ignored:
+			ti.Dropped = "ignored by rule"
+		}
+		t.Items = append(t.Items, ti)
+	}
+	return t
+}
+
+////////////////////////////////////////////////////////////////
+
+type inTraceItem struct {
+	claims  []*RulePair
+	ignores []*RulePair
+	winners []*RulePair
+}
+
+func hasRule(rules []*RulePair, rule *RulePair) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// inTracer records the outcome of each file when syncing in. A nil *inTracer
+// records nothing.
+type inTracer struct {
+	keys  []string
+	items map[string]*inTraceItem
+}
+
+func newInTracer() *inTracer {
+	return &inTracer{items: map[string]*inTraceItem{}}
+}
+
+func (tr *inTracer) get(file string) *inTraceItem {
+	item, ok := tr.items[file]
+	if !ok {
+		item = &inTraceItem{}
+		tr.items[file] = item
+		tr.keys = append(tr.keys, file)
+	}
+	return item
+}
+
+// visit adds each file in a directory as an item. Files used internally by
+// rbxfs are excluded.
+func (tr *inTracer) visit(opt *Options, dirname, subdir string) {
+	if tr == nil {
+		return
+	}
+	files, err := ioutil.ReadDir(filepath.Join(opt.Repo, dirname, subdir))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		switch file.Name() {
+		case auxDataFileName, DirRulesFileName:
+			continue
+		}
+		tr.get(filepath.Join(subdir, file.Name()))
+	}
+}
+
+// claim records that rule selected a file.
+func (tr *inTracer) claim(rule *RulePair, file string, ignore bool) {
+	if tr == nil {
+		return
+	}
+	item := tr.get(file)
+	if ignore {
+		if !hasRule(item.ignores, rule) {
+			item.ignores = append(item.ignores, rule)
+		}
+		return
+	}
+	if !hasRule(item.claims, rule) {
+		item.claims = append(item.claims, rule)
+	}
+}
+
+// resolve records the final actions of each file.
+func (tr *inTracer) resolve(actions []InAction) {
+	if tr == nil {
+		return
+	}
+	for _, action := range actions {
+		for _, sel := range action.Selection {
+			item := tr.get(filepath.Join(filepath.Join(action.Dir...), sel.File))
+			if !hasRule(item.winners, action.Rule) {
+				item.winners = append(item.winners, action.Rule)
+			}
+		}
+	}
+}
+
+func (tr *inTracer) trace(name string) *Trace {
+	t := &Trace{SyncType: SyncIn, Name: name, Items: make([]TraceItem, 0, len(tr.keys))}
+	for _, key := range tr.keys {
+		item := tr.items[key]
+		ti := TraceItem{Child: -1, Name: key}
+		var winner *RulePair
+		for _, rule := range item.winners {
+			if winner == nil || rule.Depth >= winner.Depth {
+				winner = rule
+			}
+		}
+		switch {
+		case winner != nil:
+		case len(item.ignores) > 0:
+			winner = item.ignores[len(item.ignores)-1]
+			ti.Dropped = "ignored by rule"
+		case len(item.claims) > 0:
+			ti.Dropped = "file contains no items"
+		default:
+			ti.Dropped = "no matching rule"
+		}
+		if winner != nil {
+			rule := *winner
+			ti.Rule = &rule
+		}
+		for _, rule := range append(item.claims, item.ignores...) {
+			if rule != winner && !hasRule(item.winners, rule) {
+				ti.Overridden = append(ti.Overridden, *rule)
+			}
+		}
+		t.Items = append(t.Items, ti)
+	}
+	return t
+}
+
+////////////////////////////////////////////////////////////////
+
+// ExplainOut reads each place as SyncOutReadRepo would, without writing any
+// files, and returns a trace for each place describing which rules applied
+// to each item.
+func ExplainOut(opt *Options, placeNames []string) ([]*Trace, error) {
+	rules, placeNames, err := loadRepo(opt, placeNames, getPlacesInRepo)
+	if err != nil {
+		return nil, err
+	}
+	rules = filterRuleType(rules, SyncOut)
+
+	results := make([]*Trace, len(placeNames))
+	kept, err := eachName(opt, placeNames, func(i int, opt *Options) (ok bool, err error) {
+		name := placeNames[i]
+		tr := newOutTracer(getPlaceDir(name))
+		_, actions, err := syncOutReadPlace(opt, name, rules, tr)
+		if err != nil {
+			return false, ErrsFile{&ErrFile{FileName: name, Action: "explaining", Errors: []error{err}}}
+		}
+		syncOutAnalyzeActions(actions, tr)
+		results[i] = tr.trace(name)
+		return true, nil
+	})
+	out := make([]*Trace, len(kept))
+	for j, i := range kept {
+		out[j] = results[i]
+	}
+	return out, err
+}
+
+// ExplainIn reads each directory as SyncInReadRepo would, without writing any
+// files, and returns a trace for each directory describing which rules
+// applied to each file.
+func ExplainIn(opt *Options, dirNames []string) ([]*Trace, error) {
+	rules, dirNames, err := loadRepo(opt, dirNames, getDirsInRepo)
+	if err != nil {
+		return nil, err
+	}
+	rules = filterRuleType(rules, SyncIn)
+
+	results := make([]*Trace, len(dirNames))
+	kept, err := eachName(opt, dirNames, func(i int, opt *Options) (ok bool, err error) {
+		name := dirNames[i]
+		tr := newInTracer()
+		actions, err := syncInReadDir(opt, &SourceCache{}, name, []string{}, rules, map[string]*rbxfile.Instance{}, tr)
+		if err != nil {
+			return false, ErrsFile{&ErrFile{FileName: name, Action: "explaining", Errors: []error{err}}}
+		}
+		syncInAnalyzeActions(actions, tr)
+		results[i] = tr.trace(name)
+		return true, nil
+	})
+	out := make([]*Trace, len(kept))
+	for j, i := range kept {
+		out[j] = results[i]
+	}
+	return out, err
+}
@@ -0,0 +1,165 @@
+package rbxfs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/robloxapi/rbxfile"
+	"github.com/robloxapi/rbxfile/bin"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// RoundTrip is the result of syncing a place out, and then back in.
+type RoundTrip struct {
+	Place string `json:"place"`
+	// Differences lists each difference between the original place and the
+	// place produced by syncing back in.
+	Differences []Difference `json:"differences"`
+}
+
+// Lossless returns whether the place was unchanged by the round trip.
+func (rt *RoundTrip) Lossless() bool {
+	return len(rt.Differences) == 0
+}
+
+// WriteReport writes a human-readable list of differences to w.
+func (rt *RoundTrip) WriteReport(w io.Writer) error {
+	if rt.Lossless() {
+		_, err := fmt.Fprintf(w, "verify `%s`: lossless\n", rt.Place)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "verify `%s`\n", rt.Place); err != nil {
+		return err
+	}
+	for _, diff := range rt.Differences {
+		if _, err := fmt.Fprintf(w, "\t%s\n", diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyRoundTrip syncs each place in placeNames out to a temporary
+// directory, syncs the directory back in, and compares the resulting place
+// with the original. If placeNames is empty, then all places in the
+// repository are verified. Files in the repository are not modified.
+func VerifyRoundTrip(opt *Options, placeNames []string) ([]*RoundTrip, error) {
+	rules, placeNames, err := loadRepo(opt, placeNames, getPlacesInRepo)
+	if err != nil {
+		return nil, err
+	}
+	outRules := filterRuleType(rules, SyncOut)
+	inRules := filterRuleType(rules, SyncIn)
+
+	results := make([]*RoundTrip, len(placeNames))
+	kept, err := eachName(opt, placeNames, func(i int, opt *Options) (ok bool, err error) {
+		results[i], err = verifyPlace(opt, placeNames[i], outRules, inRules)
+		return results[i] != nil, err
+	})
+	out := make([]*RoundTrip, len(kept))
+	for j, i := range kept {
+		out[j] = results[i]
+	}
+	return out, err
+}
+
+func verifyPlace(opt *Options, name string, outRules, inRules []RulePair) (*RoundTrip, error) {
+	original, err := decodePlaceFile(filepath.Join(opt.Repo, name), opt.API)
+	if err != nil {
+		return nil, err
+	}
+	place, err := decodePlaceFile(filepath.Join(opt.Repo, name), opt.API)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := syncRoundTrip(opt, name, place, outRules, inRules)
+	if err != nil {
+		return nil, err
+	}
+	b, err := syncInEncodeRoot(opt, tree)
+	if err != nil {
+		return nil, err
+	}
+	result, err := bin.DeserializePlace(bytes.NewReader(b), opt.API)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RoundTrip{Place: name, Differences: CompareRoots(original, result)}, nil
+}
+
+// syncRoundTrip syncs root out as the content of place, and then syncs the
+// result back in, returning the tree that was read. The directory is written
+// to a scratch repository within the staging directory, so the repository is
+// not modified. root is modified by the sync.
+func syncRoundTrip(opt *Options, place string, root *rbxfile.Root, outRules, inRules []RulePair) (*rbxfile.Root, error) {
+	scratch, err := newStageDir(opt.Repo, "roundtrip-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+	tmpOpt := *opt
+	tmpOpt.Repo = scratch
+	tmpOpt.Reporter = nil
+
+	dir := getPlaceDir(place)
+	if err := os.MkdirAll(filepath.Join(scratch, filepath.Dir(dir)), 0777); err != nil {
+		return nil, err
+	}
+	outActions, err := syncOutReadRoot(opt, root, place, outRules, nil)
+	if err != nil {
+		return nil, err
+	}
+	outActions = syncOutAnalyzeActions(outActions, nil)
+	plan, err := syncOutPlanActions(&tmpOpt, place, dir, root, outActions)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncOutApplyActions(&tmpOpt, plan); err != nil {
+		return nil, err
+	}
+	if err := copyDirRules(opt.Repo, scratch, dir); err != nil {
+		return nil, err
+	}
+
+	sources := &SourceCache{}
+	refs := map[string]*rbxfile.Instance{}
+	inActions, err := syncInReadDir(&tmpOpt, sources, dir, []string{}, inRules, refs, nil)
+	if err != nil {
+		return nil, err
+	}
+	inActions = syncInAnalyzeActions(inActions, nil)
+	return syncInBuildRoot(opt, refs, sources, inActions), nil
+}
+
+// copyDirRules copies each directory rule file within dir of the repository
+// at src to the same location in the repository at dst, if the containing
+// directory exists there.
+func copyDirRules(src, dst, dir string) error {
+	return filepath.Walk(filepath.Join(src, dir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() != DirRulesFileName {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if _, err := os.Stat(filepath.Dir(target)); err != nil {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, b, 0666)
+	})
+}
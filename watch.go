@@ -0,0 +1,318 @@
+package rbxfs
+
+import (
+	"github.com/robloxapi/rbxfile"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// notifier reports changes to files within a repository.
+type notifier interface {
+	// Events returns a channel that receives the path of each changed file,
+	// relative to the repository. The channel is closed when the notifier is
+	// closed.
+	Events() <-chan string
+	Close() error
+}
+
+// watchedMeta returns whether a path relative to the repository is a file
+// within the project metadata directory that affects syncing.
+func watchedMeta(path string) bool {
+	return path == filepath.Join(ProjectMetaDir, RulesFileName) ||
+		path == filepath.Join(ProjectMetaDir, "services")
+}
+
+// pollNotifier detects changes by periodically comparing the modification
+// time and size of each file.
+type pollNotifier struct {
+	repo     string
+	interval time.Duration
+	events   chan string
+	stop     chan struct{}
+	state    map[string]os.FileInfo
+}
+
+func newPollNotifier(repo string, interval time.Duration) *pollNotifier {
+	n := &pollNotifier{
+		repo:     repo,
+		interval: interval,
+		events:   make(chan string),
+		stop:     make(chan struct{}),
+	}
+	n.state = n.scan()
+	go n.run()
+	return n
+}
+
+func (n *pollNotifier) scan() map[string]os.FileInfo {
+	state := map[string]os.FileInfo{}
+	filepath.Walk(n.repo, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(n.repo, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		if info.IsDir() && info.Name() == ProjectMetaDir {
+			for _, name := range []string{RulesFileName, "services"} {
+				if info, err := os.Stat(filepath.Join(path, name)); err == nil {
+					state[filepath.Join(rel, name)] = info
+				}
+			}
+			return filepath.SkipDir
+		}
+		state[rel] = info
+		return nil
+	})
+	return state
+}
+
+func (n *pollNotifier) run() {
+	defer close(n.events)
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		state := n.scan()
+		var changed []string
+		for path, info := range state {
+			if prev, ok := n.state[path]; !ok || !prev.ModTime().Equal(info.ModTime()) || prev.Size() != info.Size() {
+				changed = append(changed, path)
+			}
+		}
+		for path := range n.state {
+			if _, ok := state[path]; !ok {
+				changed = append(changed, path)
+			}
+		}
+		n.state = state
+		for _, path := range changed {
+			select {
+			case n.events <- path:
+			case <-n.stop:
+				return
+			}
+		}
+	}
+}
+
+func (n *pollNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *pollNotifier) Close() error {
+	close(n.stop)
+	return nil
+}
+
+// inSession holds the state of a directory that is synced in repeatedly, so
+// that files that have not changed do not have to be decoded again.
+type inSession struct {
+	sources *SourceCache
+	refs    map[string]*rbxfile.Instance
+}
+
+func newInSession() *inSession {
+	return &inSession{
+		sources: &SourceCache{},
+		refs:    map[string]*rbxfile.Instance{},
+	}
+}
+
+// invalidate removes the cached source of a changed file, given as a path
+// relative to the directory.
+func (s *inSession) invalidate(name string) {
+	if base := filepath.Base(name); base == auxDataFileName {
+		name = filepath.Dir(name)
+	}
+	var unref func(*rbxfile.Instance)
+	unref = func(obj *rbxfile.Instance) {
+		if s.refs[obj.Reference] == obj {
+			delete(s.refs, obj.Reference)
+		}
+		for _, child := range obj.Children {
+			unref(child)
+		}
+	}
+	for _, item := range s.sources.Invalidate(name) {
+		if item.Source != nil {
+			for _, obj := range item.Source.Children {
+				unref(obj)
+			}
+		}
+	}
+}
+
+// reset undoes the changes made to cached sources by a previous sync. Objects
+// created from directories receive children and properties from other
+// sources, which are cleared.
+func (s *inSession) reset() {
+	s.sources.each(func(name string, item SourceCacheItem) {
+		if !item.IsDir || item.Source == nil || len(item.Source.Children) == 0 {
+			return
+		}
+		obj := item.Source.Children[0]
+		obj.RemoveAll()
+		obj.Properties = make(map[string]rbxfile.Value, 1)
+		obj.SetName(filepath.Base(name))
+	})
+}
+
+// Watcher syncs directories in whenever the files within them change.
+type Watcher struct {
+	Options *Options
+	// Dirs contains the directories to watch. If empty, then every
+	// directory in the repository is watched.
+	Dirs []string
+	// Debounce is how long to wait after a change before syncing, so that a
+	// burst of changes results in a single sync. Defaults to 200ms.
+	Debounce time.Duration
+	// Poll causes changes to be detected by polling, even if the system
+	// provides notifications.
+	Poll bool
+	// PollInterval is the interval between scans when polling. Defaults to
+	// one second.
+	PollInterval time.Duration
+}
+
+// openNotifier returns a notifier for the repository of opt. System
+// notifications are used unless poll is true or they are unavailable, in
+// which case the repository is polled at the given interval.
+func openNotifier(opt *Options, poll bool, interval time.Duration) notifier {
+	if !poll {
+		if n, err := newSystemNotifier(opt.Repo); err == nil {
+			return n
+		} else {
+			getReporter(opt).Report(Event{Kind: EventWarning, SyncType: SyncIn, Err: err})
+		}
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return newPollNotifier(opt.Repo, interval)
+}
+
+// watching returns whether dir is watched.
+func (w *Watcher) watching(dir string) bool {
+	if len(w.Dirs) == 0 {
+		return dir != ProjectMetaDir && !strings.HasPrefix(dir, ".")
+	}
+	for _, d := range w.Dirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Run syncs in each watched directory, then syncs a directory again each time
+// it changes, until stop is closed. Errors that occur while syncing are
+// passed to the reporter of the options, and do not stop the watcher.
+func (w *Watcher) Run(stop <-chan struct{}) error {
+	opt := w.Options
+	if !pathIsRepo(opt.Repo) {
+		return ErrNotRepo
+	}
+	debounce := w.Debounce
+	if debounce <= 0 {
+		debounce = 200 * time.Millisecond
+	}
+
+	n := openNotifier(opt, w.Poll, w.PollInterval)
+	defer n.Close()
+
+	dirs := w.Dirs
+	if len(dirs) == 0 {
+		dirs = getDirsInRepo(opt.Repo)
+	}
+	sessions := map[string]*inSession{}
+	pending := map[string]bool{}
+	for _, dir := range dirs {
+		pending[dir] = true
+	}
+	w.sync(sessions, pending)
+
+	pending = map[string]bool{}
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return nil
+		case path, ok := <-n.Events():
+			if !ok {
+				return nil
+			}
+			if watchedMeta(path) {
+				// Everything depends on the project rules and services, so
+				// every directory is synced from scratch.
+				sessions = map[string]*inSession{}
+				dirs := w.Dirs
+				if len(dirs) == 0 {
+					dirs = getDirsInRepo(opt.Repo)
+				}
+				for _, dir := range dirs {
+					pending[dir] = true
+				}
+			} else {
+				parts := strings.SplitN(path, string(filepath.Separator), 2)
+				if len(parts) < 2 || !w.watching(parts[0]) {
+					continue
+				}
+				if s, ok := sessions[parts[0]]; ok {
+					s.invalidate(parts[1])
+				}
+				pending[parts[0]] = true
+			}
+			timer = time.After(debounce)
+		case <-timer:
+			w.sync(sessions, pending)
+			pending = map[string]bool{}
+			timer = nil
+		}
+	}
+}
+
+// sync syncs in each pending directory, reusing the session of each
+// directory.
+func (w *Watcher) sync(sessions map[string]*inSession, pending map[string]bool) {
+	opt := w.Options
+	reporter := getReporter(opt)
+	rules, err := getStdRules(opt)
+	if err != nil {
+		reporter.Report(Event{Kind: EventError, SyncType: SyncIn, Err: err})
+		return
+	}
+	rules = filterRuleType(rules, SyncIn)
+	reporter.Report(Event{Kind: EventRulesLoaded, SyncType: SyncIn, Rules: rules})
+
+	names := make([]string, 0, len(pending))
+	for _, dir := range getDirsInRepo(opt.Repo) {
+		if pending[dir] {
+			names = append(names, dir)
+		}
+	}
+	for _, name := range names {
+		if sessions[name] == nil {
+			sessions[name] = newInSession()
+		}
+		sessions[name].reset()
+	}
+	syncEach(opt, len(names), func(i int, opt *Options) bool {
+		s := sessions[names[i]]
+		_, err := syncInDirWith(opt, names[i], rules, true, s.sources, s.refs)
+		if err != nil {
+			// The cache may be inconsistent with the failed sync.
+			s.sources = &SourceCache{}
+			s.refs = map[string]*rbxfile.Instance{}
+			return false
+		}
+		return true
+	})
+}
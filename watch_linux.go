@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package rbxfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyNotifier detects changes using inotify.
+type inotifyNotifier struct {
+	repo   string
+	file   *os.File
+	events chan string
+
+	mu    sync.Mutex
+	paths map[int32]string
+}
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF
+
+func newSystemNotifier(repo string) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotifyNotifier{
+		repo:   repo,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan string),
+		paths:  map[int32]string{},
+	}
+	if err := n.addTree(""); err != nil {
+		n.file.Close()
+		return nil, err
+	}
+	// Only the files within the project metadata directory that affect
+	// syncing are relevant, so its subdirectories are not watched.
+	if err := n.add(ProjectMetaDir); err != nil && !os.IsNotExist(err) {
+		n.file.Close()
+		return nil, err
+	}
+	go n.run()
+	return n, nil
+}
+
+// add watches a single directory, given relative to the repository.
+func (n *inotifyNotifier) add(rel string) error {
+	wd, err := syscall.InotifyAddWatch(int(n.file.Fd()), filepath.Join(n.repo, rel), inotifyMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	n.mu.Lock()
+	n.paths[int32(wd)] = rel
+	n.mu.Unlock()
+	return nil
+}
+
+// addTree watches a directory and each of its subdirectories, excluding the
+// project metadata directory.
+func (n *inotifyNotifier) addTree(rel string) error {
+	return filepath.Walk(filepath.Join(n.repo, rel), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ProjectMetaDir {
+			return filepath.SkipDir
+		}
+		r, err := filepath.Rel(n.repo, path)
+		if err != nil {
+			return err
+		}
+		if r == "." {
+			r = ""
+		}
+		return n.add(r)
+	})
+}
+
+func (n *inotifyNotifier) run() {
+	defer close(n.events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		c, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i+syscall.SizeofInotifyEvent <= c; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			name := buf[i+syscall.SizeofInotifyEvent : i+syscall.SizeofInotifyEvent+int(ev.Len)]
+			i += syscall.SizeofInotifyEvent + int(ev.Len)
+			for j, b := range name {
+				if b == 0 {
+					name = name[:j]
+					break
+				}
+			}
+
+			n.mu.Lock()
+			dir, ok := n.paths[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.paths, ev.Wd)
+			}
+			n.mu.Unlock()
+			if !ok || len(name) == 0 {
+				continue
+			}
+			path := filepath.Join(dir, string(name))
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && dir != ProjectMetaDir {
+				n.addTree(path)
+			}
+			n.events <- path
+		}
+	}
+}
+
+func (n *inotifyNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *inotifyNotifier) Close() error {
+	err := n.file.Close()
+	// Drain events so that a blocked send does not prevent the reader from
+	// stopping.
+	go func() {
+		for range n.events {
+		}
+	}()
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package rbxfs
+
+import (
+	"errors"
+)
+
+func newSystemNotifier(repo string) (notifier, error) {
+	return nil, errors.New("file notifications are not supported on this system; polling instead")
+}